@@ -3,12 +3,19 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/pooflix/engine"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Client struct {
@@ -17,6 +24,16 @@ type Client struct {
 	httpClient *http.Client
 }
 
+// Error is returned for any non 2xx response of the api
+type Error struct {
+	StatusCode int
+	Message    interface{} `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %v", e.StatusCode, e.Message)
+}
+
 func NewClient(bu *url.URL) *Client {
 	return &Client{
 		BaseURL:    bu,
@@ -36,6 +53,301 @@ func (c *Client) ListTorrents() (map[string]*engine.Torrent, error) {
 	return torrents, err
 }
 
+// AddMagnet adds torrent from magnet link, with optional category and tags
+func (c *Client) AddMagnet(link string, o engine.AddOptions) error {
+	return c.form("POST", "/torrents/magnet", url.Values{
+		"link":      {link},
+		"category":  {o.Category},
+		"tag":       o.Tags,
+		"paused":    {strconv.FormatBool(o.Paused)},
+		"ephemeral": {strconv.FormatBool(o.Ephemeral)},
+	})
+}
+
+// AddTorrentFile uploads the metainfo read from r, name is only
+// used as the file name of the upload
+func (c *Client) AddTorrentFile(name string, r io.Reader, o engine.AddOptions) error {
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	if err := w.WriteField("category", o.Category); err != nil {
+		return err
+	}
+	if err := w.WriteField("paused", strconv.FormatBool(o.Paused)); err != nil {
+		return err
+	}
+	if err := w.WriteField("ephemeral", strconv.FormatBool(o.Ephemeral)); err != nil {
+		return err
+	}
+	for _, tag := range o.Tags {
+		if err := w.WriteField("tag", tag); err != nil {
+			return err
+		}
+	}
+	part, err := w.CreateFormFile("torrent", filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	req, err := c.newRequest("POST", "/torrents/file", nil)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(buf)
+	req.ContentLength = int64(buf.Len())
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	_, err = c.do(req, nil)
+	return err
+}
+
+// CreateTorrent creates torrent from path in download directory of server, which starts seeding it
+func (c *Client) CreateTorrent(o engine.CreateOptions) (*engine.CreatedTorrent, error) {
+	values := url.Values{
+		"path":         {o.Path},
+		"piece_length": {strconv.FormatInt(o.PieceLength, 10)},
+		"tracker":      o.Trackers,
+		"webseed":      o.WebSeeds,
+		"private":      {strconv.FormatBool(o.Private)},
+		"comment":      {o.Comment},
+	}
+	body := values.Encode()
+
+	req, err := c.newRequest("POST", "/torrents/create", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	created := new(engine.CreatedTorrent)
+	if _, err := c.do(req, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// DeleteTorrent removes torrent, with deleteData its files are deleted as well
+func (c *Client) DeleteTorrent(infohash string, deleteData bool) error {
+	req, err := c.newRequest("DELETE", "/torrents/"+infohash, nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = url.Values{"data": {strconv.FormatBool(deleteData)}}.Encode()
+
+	_, err = c.do(req, nil)
+	return err
+}
+
+func (c *Client) PauseTorrent(infohash string) error {
+	return c.post("/torrents/" + infohash + "/pause")
+}
+
+func (c *Client) ResumeTorrent(infohash string) error {
+	return c.post("/torrents/" + infohash + "/resume")
+}
+
+// SetFilePriority changes priority of file by its index in torrent
+func (c *Client) SetFilePriority(infohash string, id int, p engine.Priority) error {
+	return c.form("PUT", fmt.Sprintf("/torrents/%s/files/%d/priority", infohash, id), url.Values{
+		"priority": {string(p)},
+	})
+}
+
+// SetRateLimits changes global rate limits in bytes per second, 0 is unlimited
+func (c *Client) SetRateLimits(download, upload int64) error {
+	return c.form("PUT", "/limits", url.Values{
+		"download": {strconv.FormatInt(download, 10)},
+		"upload":   {strconv.FormatInt(upload, 10)},
+	})
+}
+
+// DiskSpace returns free disk space of server and whether downloads are held back
+func (c *Client) DiskSpace() (*engine.DiskSpace, error) {
+	req, err := c.newRequest("GET", "/disk", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := new(engine.DiskSpace)
+	if _, err := c.do(req, disk); err != nil {
+		return nil, err
+	}
+
+	return disk, nil
+}
+
+// SetAltSpeed turns alternative speed on or off
+func (c *Client) SetAltSpeed(on bool) error {
+	return c.form("PUT", "/limits/alternative", url.Values{
+		"enabled": {strconv.FormatBool(on)},
+	})
+}
+
+// SetTorrentRateLimits overrides global download limit for single torrent
+func (c *Client) SetTorrentRateLimits(infohash string, download int64) error {
+	return c.form("PUT", "/torrents/"+infohash+"/limits", url.Values{
+		"download": {strconv.FormatInt(download, 10)},
+	})
+}
+
+// SetSeedingGoals changes global share ratio and seeding time after which torrents are paused
+func (c *Client) SetSeedingGoals(ratio float32, seedTime time.Duration) error {
+	return c.form("PUT", "/seeding", url.Values{
+		"ratio": {strconv.FormatFloat(float64(ratio), 'f', -1, 32)},
+		"time":  {seedTime.String()},
+	})
+}
+
+// SetTorrentSeedingGoals overrides global seeding goals for single torrent
+func (c *Client) SetTorrentSeedingGoals(infohash string, ratio float32, seedTime time.Duration) error {
+	return c.form("PUT", "/torrents/"+infohash+"/seeding", url.Values{
+		"ratio": {strconv.FormatFloat(float64(ratio), 'f', -1, 32)},
+		"time":  {seedTime.String()},
+	})
+}
+
+// SetQueueLimits changes how many torrents download and seed at the same time, 0 is unlimited
+func (c *Client) SetQueueLimits(downloads, seeds int) error {
+	return c.form("PUT", "/queue", url.Values{
+		"downloads": {strconv.Itoa(downloads)},
+		"seeds":     {strconv.Itoa(seeds)},
+	})
+}
+
+// MoveInQueue moves torrent engine.QueueUp, engine.QueueDown, engine.QueueTop or engine.QueueBottom
+func (c *Client) MoveInQueue(infohash, move string) error {
+	return c.post("/torrents/" + infohash + "/queue/" + move)
+}
+
+func (c *Client) ListTrackers(infohash string) ([]engine.Tracker, error) {
+	req, err := c.newRequest("GET", "/torrents/"+infohash+"/trackers", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var trackers []engine.Tracker
+	_, err = c.do(req, &trackers)
+	return trackers, err
+}
+
+// AddTracker adds tracker to tier of torrent, negative tier adds a new tier
+func (c *Client) AddTracker(infohash, trackerURL string, tier int) error {
+	return c.form("POST", "/torrents/"+infohash+"/trackers", url.Values{
+		"url":  {trackerURL},
+		"tier": {strconv.Itoa(tier)},
+	})
+}
+
+func (c *Client) RemoveTracker(infohash, trackerURL string) error {
+	req, err := c.newRequest("DELETE", "/torrents/"+infohash+"/trackers", nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = url.Values{"url": {trackerURL}}.Encode()
+
+	_, err = c.do(req, nil)
+	return err
+}
+
+func (c *Client) Reannounce(infohash string) error {
+	return c.post("/torrents/" + infohash + "/reannounce")
+}
+
+func (c *Client) ListCategories() ([]engine.Category, error) {
+	req, err := c.newRequest("GET", "/categories", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var categories []engine.Category
+	_, err = c.do(req, &categories)
+	return categories, err
+}
+
+// SetCategory creates or changes category, relative save path is relative to download directory of server
+func (c *Client) SetCategory(category engine.Category) error {
+	return c.form("PUT", "/categories/"+url.PathEscape(category.Name), url.Values{
+		"save_path":      {category.SavePath},
+		"download_limit": {strconv.FormatInt(category.DownloadLimit, 10)},
+	})
+}
+
+func (c *Client) RemoveCategory(name string) error {
+	req, err := c.newRequest("DELETE", "/categories/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(req, nil)
+	return err
+}
+
+// SetTorrentCategory puts torrent into category, empty category removes it from its category
+func (c *Client) SetTorrentCategory(infohash, category string) error {
+	return c.form("PUT", "/torrents/"+infohash+"/category", url.Values{
+		"category": {category},
+	})
+}
+
+func (c *Client) SetTorrentTags(infohash string, tags []string) error {
+	return c.form("PUT", "/torrents/"+infohash+"/tags", url.Values{
+		"tag": tags,
+	})
+}
+
+// RecheckTorrent hashes all pieces of torrent again, progress is reported in its listing
+func (c *Client) RecheckTorrent(infohash string) error {
+	return c.post("/torrents/" + infohash + "/recheck")
+}
+
+// MoveStorage moves data of torrent to path relative to storage root of server
+func (c *Client) MoveStorage(infohash, dir string) error {
+	return c.form("PUT", "/torrents/"+infohash+"/storage", url.Values{
+		"path": {dir},
+	})
+}
+
+// SetTorrentStreaming switches sequential download of whole torrent
+func (c *Client) SetTorrentStreaming(infohash string, on bool) error {
+	return c.form("PUT", "/torrents/"+infohash+"/streaming", url.Values{
+		"enabled": {strconv.FormatBool(on)},
+	})
+}
+
+// SetFileStreaming switches sequential download of file by its index in torrent
+func (c *Client) SetFileStreaming(infohash string, id int, on bool) error {
+	return c.form("PUT", fmt.Sprintf("/torrents/%s/files/%d/streaming", infohash, id), url.Values{
+		"enabled": {strconv.FormatBool(on)},
+	})
+}
+
+func (c *Client) post(p string) error {
+	return c.form("POST", p, nil)
+}
+
+func (c *Client) form(method, p string, values url.Values) error {
+	req, err := c.newRequest(method, p, nil)
+	if err != nil {
+		return err
+	}
+	if values != nil {
+		body := values.Encode()
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	_, err = c.do(req, nil)
+	return err
+}
+
 func (c *Client) newRequest(method, p string, body interface{}) (*http.Request, error) {
 	rel := &url.URL{Path: path.Join(c.BaseURL.Path, p)}
 	u := c.BaseURL.ResolveReference(rel)
@@ -66,6 +378,14 @@ func (c *Client) do(req *http.Request, v interface{}) (*http.Response, error) {
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return resp, apiErr
+	}
+	if v == nil {
+		return resp, nil
+	}
 	err = json.NewDecoder(resp.Body).Decode(v)
 	if err != nil {
 		log.Printf("Client: can't decode, %v", err)
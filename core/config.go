@@ -5,13 +5,42 @@ import (
 	"errors"
 	"github.com/creasty/defaults"
 	"github.com/imdario/mergo"
+	"github.com/pooflix/engine"
 	"os"
 )
 
 type Config struct {
-	ConfigFilePath    string `json:"-"`
-	DownloadDirectory string `json:"download_directory" default:"./downloads"`
-	HttpServerPort    string `json:"http_server_port" default:"8080"`
+	ConfigFilePath      string  `json:"-"`
+	DownloadDirectory   string  `json:"download_directory" default:"./downloads"`
+	HttpServerPort      string  `json:"http_server_port" default:"8080"`
+	SessionDirectory    string  `json:"session_directory" default:"./session"`
+	DownloadRate        int64   `json:"download_rate"`
+	UploadRate          int64   `json:"upload_rate"`
+	EnableSeeding       bool    `json:"enable_seeding"`
+	SeedRatio           float32 `json:"seed_ratio"`
+	SeedTime            string  `json:"seed_time"`
+	MaxActiveDownloads  int     `json:"max_active_downloads"`
+	MaxActiveSeeds      int     `json:"max_active_seeds"`
+	IncomingPort        int     `json:"incoming_port" default:"50007"`
+	ListenAddress       string  `json:"listen_address"`
+	IncompleteDirectory string  `json:"incomplete_directory"`
+	CompletedDirectory  string  `json:"completed_directory"`
+	StorageRoot         string  `json:"storage_root"`
+	WatchDirectory      string  `json:"watch_directory"`
+	WatchCategory       string  `json:"watch_category"`
+	WatchPaused         bool    `json:"watch_paused"`
+	AltDownloadRate     int64   `json:"alt_download_rate"`
+	AltUploadRate       int64   `json:"alt_upload_rate"`
+	MinFreeSpace        int64   `json:"min_free_space"`
+	DownloadQuota       int64   `json:"download_quota"`
+	RefuseLowSpace      bool    `json:"refuse_low_space"`
+	Storage             string  `json:"storage"`
+	PieceCompletion     string  `json:"piece_completion"`
+	StreamCacheSize     int64   `json:"stream_cache_size"`
+	StreamCacheFile     bool    `json:"stream_cache_file"`
+
+	SpeedProfiles []engine.SpeedProfile  `json:"speed_profiles"`
+	SpeedSchedule []engine.ScheduleEntry `json:"speed_schedule"`
 }
 
 func NewDefaultClientConfig() (*Config, error) {
@@ -5,17 +5,23 @@ import (
 	"github.com/labstack/echo"
 	"github.com/pooflix/engine"
 	"github.com/pooflix/server"
+	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type Core struct {
 	config *Config
 	//torrent engine
-	engine *engine.Engine
-	http   *server.Server
-	state  struct {
+	engine TorrentEngine
+	//feeds followed for torrents
+	feeds *feeds
+	http  *server.Server
+	state struct {
 		sync.Mutex
 		Config engine.Config
 		//SearchProviders scraper.Config
@@ -61,14 +67,44 @@ func (c *Core) InitializeForeground() error {
 
 	//configure engine
 	ec := engine.Config{
-		DownloadDirectory: c.config.DownloadDirectory,
-		DisableEncryption: true,
-		EnableUpload:      true,
-		EnableSeeding:     false,
-		AutoStart:         true,
+		DownloadDirectory:   c.config.DownloadDirectory,
+		SessionDirectory:    c.config.SessionDirectory,
+		DownloadRate:        c.config.DownloadRate,
+		UploadRate:          c.config.UploadRate,
+		DisableEncryption:   true,
+		EnableUpload:        true,
+		EnableSeeding:       c.config.EnableSeeding,
+		SeedRatio:           c.config.SeedRatio,
+		MaxActiveDownloads:  c.config.MaxActiveDownloads,
+		MaxActiveSeeds:      c.config.MaxActiveSeeds,
+		IncomingPort:        c.config.IncomingPort,
+		ListenAddress:       c.config.ListenAddress,
+		IncompleteDirectory: c.config.IncompleteDirectory,
+		CompletedDirectory:  c.config.CompletedDirectory,
+		StorageRoot:         c.config.StorageRoot,
+		SpeedProfiles:       c.config.SpeedProfiles,
+		SpeedSchedule:       c.config.SpeedSchedule,
+		AltDownloadRate:     c.config.AltDownloadRate,
+		AltUploadRate:       c.config.AltUploadRate,
+		MinFreeSpace:        c.config.MinFreeSpace,
+		DownloadQuota:       c.config.DownloadQuota,
+		RefuseLowSpace:      c.config.RefuseLowSpace,
+		Storage:             c.config.Storage,
+		PieceCompletion:     c.config.PieceCompletion,
+		StreamCacheSize:     c.config.StreamCacheSize,
+		StreamCacheFile:     c.config.StreamCacheFile,
+		AutoStart:           true,
 	}
 
-	if ec.IncomingPort <= 0 || ec.IncomingPort >= 65535 {
+	if c.config.SeedTime != "" {
+		d, err := time.ParseDuration(c.config.SeedTime)
+		if err != nil {
+			return fmt.Errorf("invalid seed time: %v", err)
+		}
+		ec.SeedTime = d
+	}
+
+	if ec.IncomingPort <= 0 || ec.IncomingPort > 65535 {
 		ec.IncomingPort = 50007
 	}
 
@@ -76,13 +112,19 @@ func (c *Core) InitializeForeground() error {
 		return fmt.Errorf("initial configure failed: %v", err)
 	}
 
+	//feed subscriptions
+	var err error
+	c.feeds, err = newFeeds(filepath.Join(c.config.SessionDirectory, "feeds.json"), c.engine)
+	if err != nil {
+		return fmt.Errorf("invalid feeds: %v", err)
+	}
+
 	//dns service
 	if err := NewDns(); err != nil {
 		return err
 	}
 
 	//http service
-	var err error
 	c.http, err = server.New(&server.Config{
 		IncomingPort: c.config.HttpServerPort,
 	})
@@ -95,45 +137,105 @@ func (c *Core) InitializeForeground() error {
 
 // InitializeBackground starts Action processing and RecurringServices for *Core.
 func (c *Core) InitializeBackground() error {
-	//poll torrents and files
+	//follow torrents and files as the engine changes them
+	events, _ := c.engine.Subscribe()
 	go func() {
-		for {
+		for ev := range events {
+			if ev.Type == engine.EventPieceCompleted {
+				continue
+			}
 			c.state.Lock()
 			c.state.Torrents = c.engine.GetTorrents()
 			//s.state.Downloads = s.listFiles()
 			c.state.Unlock()
-			time.Sleep(1 * time.Second)
 		}
 	}()
 
-	// Middleware set custom echo context
-	c.http.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(ctx echo.Context) error {
-			return next(&CustomContext{
-				Context: ctx,
-				Core:    c,
-			})
+	//add torrents dropped into watch directory
+	if c.config.WatchDirectory != "" {
+		w, err := newWatcher(c.config.WatchDirectory, engine.AddOptions{
+			Category: c.config.WatchCategory,
+			Paused:   c.config.WatchPaused,
+		}, c.engine)
+		if err != nil {
+			return fmt.Errorf("invalid watch directory: %v", err)
 		}
-	})
+		go w.run()
+	}
+
+	//add torrents of followed feeds
+	go c.feeds.run()
+
+	//save the torrents before going down
+	go c.closeOnSignal()
+
+	// Middleware set custom echo context
+	c.http.Use(c.customContext)
 
 	//run http server
 	return c.http.Run(routes)
 }
 
+// closeOnSignal closes the engine and exits once
+// the process gets interrupted or terminated
+func (c *Core) closeOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if err := c.engine.Close(); err != nil {
+		log.Printf("Core: can't close engine, %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func (c *Core) customContext(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return next(&CustomContext{
+			Context: ctx,
+			Core:    c,
+		})
+	}
+}
+
 func (c *Core) reconfigure(ec engine.Config) error {
-	dldir, err := filepath.Abs(c.config.DownloadDirectory)
+	dldir, err := filepath.Abs(ec.DownloadDirectory)
 
 	if err != nil {
 		return fmt.Errorf("invalid path: %v", err)
 	}
 
 	c.config.DownloadDirectory = dldir
+	ec.DownloadDirectory = dldir
+
+	sessdir, err := filepath.Abs(ec.SessionDirectory)
+
+	if err != nil {
+		return fmt.Errorf("invalid path: %v", err)
+	}
+
+	c.config.SessionDirectory = sessdir
+	ec.SessionDirectory = sessdir
+
+	for _, dir := range []*string{&ec.IncompleteDirectory, &ec.CompletedDirectory, &ec.StorageRoot} {
+		if *dir == "" {
+			continue
+		}
+		if *dir, err = filepath.Abs(*dir); err != nil {
+			return fmt.Errorf("invalid path: %v", err)
+		}
+	}
+	c.config.IncompleteDirectory = ec.IncompleteDirectory
+	c.config.CompletedDirectory = ec.CompletedDirectory
+	c.config.StorageRoot = ec.StorageRoot
 
 	if err := c.engine.Configure(ec); err != nil {
 		return err
 	}
 
-	c.state.Config = ec
+	c.state.Lock()
+	c.state.Config = c.engine.Config()
+	c.state.Unlock()
 
 	return nil
 }
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"github.com/anacrolix/torrent"
+	"github.com/labstack/echo"
+	"github.com/pooflix/engine"
+	"net/http"
+	"time"
+)
+
+// TorrentEngine is the torrent engine core serves, *engine.Engine
+// implements it on top of anacrolix and enginetest.Engine in memory
+type TorrentEngine interface {
+	Config() engine.Config
+	Configure(c engine.Config) error
+	Close() error
+	Subscribe() (events <-chan engine.Event, cancel func())
+
+	//torrents
+	NewMagnet(magnetURI string, o engine.AddOptions) error
+	NewTorrent(spec *torrent.TorrentSpec, o engine.AddOptions) error
+	GetTorrents() map[string]*engine.Torrent
+	GetTorrent(infohash string) (*engine.Torrent, error)
+	StartTorrent(infohash string) error
+	StopTorrent(infohash string) error
+	PauseTorrent(infohash string) error
+	ResumeTorrent(infohash string) error
+	DeleteTorrent(infohash string, deleteData bool) error
+	RecheckTorrent(infohash string) error
+	MoveStorage(infohash, dir string) error
+	CreateTorrent(o engine.CreateOptions) (*engine.CreatedTorrent, error)
+	Metainfo(infohash string) ([]byte, error)
+
+	//files
+	SetFilePriority(infohash, filepath string, p engine.Priority) error
+	SetTorrentStreaming(infohash string, on bool) error
+	SetFileStreaming(infohash, filepath string, on bool) error
+	NewFileReader(infohash string, id int) (engine.FileReader, error)
+
+	//categories and tags
+	Categories() []engine.Category
+	SetCategory(c engine.Category) error
+	RemoveCategory(name string) error
+	SetTorrentCategory(infohash, category string) error
+	SetTorrentTags(infohash string, tags []string) error
+
+	//limits, seeding goals and queue
+	SetRateLimits(download, upload int64) error
+	SetAltSpeed(on bool) error
+	DiskSpace() (engine.DiskSpace, error)
+	SetTorrentRateLimits(infohash string, download int64) error
+	SetSeedingGoals(ratio float32, seedTime time.Duration) error
+	SetTorrentSeedingGoals(infohash string, ratio float32, seedTime time.Duration) error
+	SetQueueLimits(downloads, seeds int) error
+	MoveInQueue(infohash, move string) error
+
+	//trackers
+	Trackers(infohash string) ([]engine.Tracker, error)
+	AddTracker(infohash, u string, tier int) error
+	RemoveTracker(infohash, u string) error
+	Reannounce(infohash string) error
+}
+
+var _ TorrentEngine = (*engine.Engine)(nil)
+
+// NewHandler serves the api against the given engine, without
+// configuring it or starting any service, e.g. for an in-memory
+// engine from enginetest
+func NewHandler(cfg *Config, e TorrentEngine) http.Handler {
+	c := &Core{config: cfg, engine: e}
+	c.feeds, _ = newFeeds("", e)
+	h := echo.New()
+	h.Use(c.customContext)
+	routes(h)
+	return h
+}
@@ -0,0 +1,566 @@
+package core
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pooflix/engine"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feed is an RSS or Atom feed polled for torrents
+type Feed struct {
+	URL string `json:"url"`
+	//how often the feed is polled, e.g. 30m
+	Interval   string    `json:"interval"`
+	LastPolled time.Time `json:"last_polled"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// FeedRule adds the items of feeds that match it
+type FeedRule struct {
+	Name string `json:"name"`
+	//only items of this feed, empty matches items of every feed
+	Feed string `json:"feed,omitempty"`
+	//case insensitive regular expressions on the item title
+	Include string `json:"include,omitempty"`
+	Exclude string `json:"exclude,omitempty"`
+	//size bounds in bytes, items of unknown size never match a bound
+	MinSize int64 `json:"min_size,omitempty"`
+	MaxSize int64 `json:"max_size,omitempty"`
+	//add each episode of a show, e.g. Show S01E02, only once
+	Episodes bool     `json:"episodes,omitempty"`
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Paused   bool     `json:"paused,omitempty"`
+}
+
+const (
+	defaultFeedInterval = 30 * time.Minute
+	minFeedInterval     = 5 * time.Minute
+	//seen items are forgotten after a while, feeds drop them long before
+	feedSeenExpiry = 90 * 24 * time.Hour
+	//largest .torrent downloaded for a feed item, or uploaded
+	maxFeedTorrentSize = 10 << 20
+	//attempts to add an item before it is given up on
+	maxFeedAddAttempts = 5
+)
+
+var episodeRegexp = regexp.MustCompile(`(?i)\bs(\d{1,2})\s?e(\d{1,3})\b|\b(\d{1,2})x(\d{2,3})\b`)
+
+var nonAlphanumericRegexp = regexp.MustCompile(`[^\pL\pN]+`)
+
+// feeds polls feeds and adds the items matching a rule, which
+// items were handled is kept across restarts in a file at path
+type feeds struct {
+	sync.Mutex
+	//one poll at a time, items are not added twice
+	polling sync.Mutex
+	path    string
+	engine  TorrentEngine
+	client  *http.Client
+	Feeds   []*Feed    `json:"feeds"`
+	Rules   []FeedRule `json:"rules"`
+	//ids of handled items, by when they were handled
+	Seen map[string]time.Time `json:"seen"`
+	//ids of items that failed to be added, tried again on later polls
+	Retries map[string]feedRetry `json:"retries,omitempty"`
+	//episodes added by every rule
+	Episodes map[string][]string `json:"episodes"`
+}
+
+// feedRetry counts the failed attempts to add an item
+type feedRetry struct {
+	Attempts int       `json:"attempts"`
+	At       time.Time `json:"at"`
+}
+
+func newFeeds(path string, e TorrentEngine) (*feeds, error) {
+	f := &feeds{
+		path:     path,
+		engine:   e,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		Seen:     map[string]time.Time{},
+		Retries:  map[string]feedRetry{},
+		Episodes: map[string][]string{},
+	}
+
+	if path == "" {
+		return f, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+
+	//feeds.json of older versions has no retries
+	if f.Retries == nil {
+		f.Retries = map[string]feedRetry{}
+	}
+
+	return f, nil
+}
+
+// save must be called with f locked
+func (f *feeds) save() error {
+	if f.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, f.path)
+}
+
+func (f *feeds) list() ([]Feed, []FeedRule) {
+	f.Lock()
+	defer f.Unlock()
+
+	list := make([]Feed, len(f.Feeds))
+	for i, feed := range f.Feeds {
+		list[i] = *feed
+	}
+
+	return list, append([]FeedRule(nil), f.Rules...)
+}
+
+func (f *feeds) addFeed(u, interval string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("invalid feed url (%s)", u)
+	}
+
+	if _, err := feedInterval(interval); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for _, feed := range f.Feeds {
+		if feed.URL == u {
+			return fmt.Errorf("feed already added")
+		}
+	}
+
+	f.Feeds = append(f.Feeds, &Feed{URL: u, Interval: interval})
+	return f.save()
+}
+
+func (f *feeds) removeFeed(u string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	for i, feed := range f.Feeds {
+		if feed.URL == u {
+			f.Feeds = append(f.Feeds[:i], f.Feeds[i+1:]...)
+			return f.save()
+		}
+	}
+
+	return fmt.Errorf("missing feed %s", u)
+}
+
+// setRule adds a rule or replaces the one of the same name
+func (f *feeds) setRule(r FeedRule) error {
+	if r.Name == "" {
+		return fmt.Errorf("missing rule name")
+	}
+
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MinSize > r.MaxSize) {
+		return fmt.Errorf("invalid size bounds")
+	}
+
+	for _, expr := range []string{r.Include, r.Exclude} {
+		if _, err := compileRuleRegexp(expr); err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for i := range f.Rules {
+		if f.Rules[i].Name == r.Name {
+			f.Rules[i] = r
+			return f.save()
+		}
+	}
+
+	f.Rules = append(f.Rules, r)
+	return f.save()
+}
+
+func (f *feeds) removeRule(name string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	for i := range f.Rules {
+		if f.Rules[i].Name == name {
+			f.Rules = append(f.Rules[:i], f.Rules[i+1:]...)
+			delete(f.Episodes, name)
+			return f.save()
+		}
+	}
+
+	return fmt.Errorf("missing rule %s", name)
+}
+
+func (f *feeds) run() {
+	f.poll(false)
+	for range time.Tick(1 * time.Minute) {
+		f.poll(false)
+	}
+}
+
+// poll fetches every feed that is due, or all of them when forced
+func (f *feeds) poll(force bool) {
+	f.polling.Lock()
+	defer f.polling.Unlock()
+
+	f.Lock()
+	var due []Feed
+	for _, feed := range f.Feeds {
+		interval, _ := feedInterval(feed.Interval)
+		if force || time.Since(feed.LastPolled) >= interval {
+			due = append(due, *feed)
+		}
+	}
+	f.Unlock()
+
+	for _, feed := range due {
+		err := f.pollFeed(feed.URL)
+
+		f.Lock()
+		for _, ff := range f.Feeds {
+			if ff.URL == feed.URL {
+				ff.LastPolled = time.Now()
+				ff.LastError = ""
+				if err != nil {
+					ff.LastError = err.Error()
+				}
+			}
+		}
+		for id, at := range f.Seen {
+			if time.Since(at) > feedSeenExpiry {
+				delete(f.Seen, id)
+			}
+		}
+		for id, r := range f.Retries {
+			if time.Since(r.At) > feedSeenExpiry {
+				delete(f.Retries, id)
+			}
+		}
+		if err := f.save(); err != nil {
+			log.Printf("Core: can't save feeds, %v", err)
+		}
+		f.Unlock()
+
+		if err != nil {
+			log.Printf("Core: can't poll feed %s, %v", feed.URL, err)
+		}
+	}
+}
+
+// feedItem is an item of either kind of feed
+type feedItem struct {
+	ID    string
+	Title string
+	//.torrent or magnet link
+	URL  string
+	Size int64
+}
+
+func (f *feeds) pollFeed(u string) error {
+	items, err := f.fetch(u)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	rules := append([]FeedRule(nil), f.Rules...)
+	f.Unlock()
+
+	for _, item := range items {
+		id := u + "#" + item.ID
+
+		f.Lock()
+		_, seen := f.Seen[id]
+		f.Unlock()
+
+		if seen {
+			continue
+		}
+
+		added, failed := false, false
+		for _, r := range rules {
+			if r.Feed != "" && r.Feed != u {
+				continue
+			}
+
+			episode, ok := f.match(r, item)
+			if !ok {
+				continue
+			}
+
+			if err := f.add(r, item); err != nil {
+				log.Printf("Core: can't add %s of feed %s, %v", item.Title, u, err)
+				failed = true
+				continue
+			}
+
+			log.Printf("Core: added %s of feed %s by rule %s", item.Title, u, r.Name)
+			if episode != "" {
+				f.Lock()
+				f.Episodes[r.Name] = append(f.Episodes[r.Name], episode)
+				f.Unlock()
+			}
+
+			added = true
+			break
+		}
+
+		//items that matched but failed to be added are tried again on later polls
+		f.Lock()
+		if failed && !added {
+			retry := f.Retries[id]
+			retry.Attempts++
+			retry.At = time.Now()
+			if retry.Attempts < maxFeedAddAttempts {
+				f.Retries[id] = retry
+				f.Unlock()
+				continue
+			}
+			log.Printf("Core: giving up on %s of feed %s after %d attempts", item.Title, u, retry.Attempts)
+		}
+		delete(f.Retries, id)
+		f.Seen[id] = time.Now()
+		f.Unlock()
+	}
+
+	return nil
+}
+
+// match tells whether item matches r, and which episode it is
+// when r only adds each episode once
+func (f *feeds) match(r FeedRule, item feedItem) (string, bool) {
+	include, _ := compileRuleRegexp(r.Include)
+	exclude, _ := compileRuleRegexp(r.Exclude)
+
+	if include != nil && !include.MatchString(item.Title) {
+		return "", false
+	}
+
+	if exclude != nil && exclude.MatchString(item.Title) {
+		return "", false
+	}
+
+	if (r.MinSize > 0 || r.MaxSize > 0) && item.Size <= 0 {
+		return "", false
+	}
+
+	if (r.MinSize > 0 && item.Size < r.MinSize) || (r.MaxSize > 0 && item.Size > r.MaxSize) {
+		return "", false
+	}
+
+	if !r.Episodes {
+		return "", true
+	}
+
+	episode := episodeOf(item.Title)
+	if episode == "" {
+		return "", true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for _, e := range f.Episodes[r.Name] {
+		if e == episode {
+			return "", false
+		}
+	}
+
+	return episode, true
+}
+
+func (f *feeds) add(r FeedRule, item feedItem) error {
+	o := engine.AddOptions{Category: r.Category, Tags: r.Tags, Paused: r.Paused}
+
+	if strings.HasPrefix(item.URL, "magnet:") {
+		return f.engine.NewMagnet(item.URL, o)
+	}
+
+	resp, err := f.client.Get(item.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	spec, err := engine.LoadTorrentSpec(io.LimitReader(resp.Body, maxFeedTorrentSize))
+	if err != nil {
+		return err
+	}
+
+	return f.engine.NewTorrent(spec, o)
+}
+
+// the elements of RSS and Atom documents items are read from
+type feedDocument struct {
+	Items []struct {
+		Title     string `xml:"title"`
+		Link      string `xml:"link"`
+		GUID      string `xml:"guid"`
+		MagnetURI string `xml:"magnetURI"`
+		Length    int64  `xml:"contentLength"`
+		Enclosure struct {
+			URL    string `xml:"url,attr"`
+			Length int64  `xml:"length,attr"`
+		} `xml:"enclosure"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href   string `xml:"href,attr"`
+			Rel    string `xml:"rel,attr"`
+			Type   string `xml:"type,attr"`
+			Length int64  `xml:"length,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+func (f *feeds) fetch(u string) ([]feedItem, error) {
+	resp, err := f.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var doc feedDocument
+	if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var items []feedItem
+	for _, i := range doc.Items {
+		item := feedItem{ID: i.GUID, Title: i.Title, URL: i.Link, Size: i.Length}
+		switch {
+		case i.MagnetURI != "":
+			item.URL = i.MagnetURI
+		case i.Enclosure.URL != "":
+			item.URL = i.Enclosure.URL
+		}
+		if i.Enclosure.Length > 0 {
+			item.Size = i.Enclosure.Length
+		}
+		items = append(items, item)
+	}
+
+	for _, e := range doc.Entries {
+		item := feedItem{ID: e.ID, Title: e.Title}
+		for _, l := range e.Links {
+			if item.URL == "" || l.Rel == "enclosure" || l.Type == "application/x-bittorrent" {
+				item.URL = l.Href
+				item.Size = l.Length
+			}
+		}
+		items = append(items, item)
+	}
+
+	//items without an id are told apart by their link
+	valid := items[:0]
+	for _, item := range items {
+		if item.URL == "" {
+			continue
+		}
+		if item.ID == "" {
+			item.ID = item.URL
+		}
+		valid = append(valid, item)
+	}
+
+	return valid, nil
+}
+
+func feedInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultFeedInterval, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < minFeedInterval {
+		return 0, fmt.Errorf("invalid interval (%s), at least %s", s, minFeedInterval)
+	}
+
+	return d, nil
+}
+
+func compileRuleRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("(?i)" + expr)
+}
+
+// episodeOf returns the show, as the title before season and episode,
+// and season and episode in the title, e.g. Show.Name.S01E02 is
+// "show name s01e02", so that episodes of different shows differ
+func episodeOf(title string) string {
+	m := episodeRegexp.FindStringSubmatchIndex(title)
+	if m == nil {
+		return ""
+	}
+
+	group := func(i int) string {
+		if m[2*i] < 0 {
+			return ""
+		}
+		return title[m[2*i]:m[2*i+1]]
+	}
+
+	season, episode := group(1), group(2)
+	if season == "" {
+		season, episode = group(3), group(4)
+	}
+
+	show := nonAlphanumericRegexp.ReplaceAllString(strings.ToLower(title[:m[0]]), " ")
+	s, _ := strconv.Atoi(season)
+	e, _ := strconv.Atoi(episode)
+	return strings.TrimSpace(fmt.Sprintf("%s s%02de%02d", strings.TrimSpace(show), s, e))
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"fmt"
+	"github.com/pooflix/engine/enginetest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// feedServer serves feed documents and .torrent files by path,
+// paths it has nothing for are not found
+type feedServer struct {
+	sync.Mutex
+	*httptest.Server
+	docs map[string][]byte
+}
+
+func newFeedServer() *feedServer {
+	s := &feedServer{docs: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		b, ok := s.docs[r.URL.Path]
+		s.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	return s
+}
+
+func (s *feedServer) serve(path string, b []byte) {
+	s.Lock()
+	s.docs[path] = b
+	s.Unlock()
+}
+
+// magnet is a magnet link of the torrent enginetest names title,
+// escaped to be put into a feed document
+func magnet(title string) string {
+	return "magnet:?xt=urn:btih:" + enginetest.InfoHash(title) + "&amp;dn=" + url.QueryEscape(title)
+}
+
+func rss(items ...string) []byte {
+	return []byte(`<?xml version="1.0"?><rss version="2.0"><channel><title>feed</title>` +
+		strings.Join(items, "") + `</channel></rss>`)
+}
+
+func rssItem(title string, size int64) string {
+	return fmt.Sprintf(`<item><title>%s</title><guid>%s</guid><enclosure url="%s" length="%d" type="application/x-bittorrent"/></item>`,
+		title, title, magnet(title), size)
+}
+
+func atom(entries ...string) []byte {
+	return []byte(`<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"><title>feed</title>` +
+		strings.Join(entries, "") + `</feed>`)
+}
+
+func atomEntry(title string, size int64) string {
+	return fmt.Sprintf(`<entry><title>%s</title><id>urn:%s</id><link href="http://example.com/%s"/><link rel="enclosure" type="application/x-bittorrent" href="%s" length="%d"/></entry>`,
+		title, title, url.PathEscape(title), magnet(title), size)
+}
+
+// newTestFeeds returns feeds kept in a temporary directory,
+// following the feed at u, which cleanup removes
+func newTestFeeds(t *testing.T, e TorrentEngine, u string) (f *feeds, path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "feeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "feeds.json")
+	if f, err = newFeeds(path, e); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := f.addFeed(u, ""); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return f, path, func() { os.RemoveAll(dir) }
+}
+
+// added returns the names of the torrents of e, sorted
+func added(e *enginetest.Engine) []string {
+	var names []string
+	for _, t := range e.GetTorrents() {
+		names = append(names, t.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectAdded(t *testing.T, e *enginetest.Engine, names ...string) {
+	t.Helper()
+	sort.Strings(names)
+	if got := added(e); strings.Join(got, "|") != strings.Join(names, "|") {
+		t.Fatalf("expected %q added, got %q", names, got)
+	}
+}
+
+func TestFeedRSS(t *testing.T) {
+	s := newFeedServer()
+	defer s.Close()
+	s.serve("/rss", rss(
+		rssItem("Show.A.S01E01.720p", 700<<20),
+		rssItem("Show.A.S01E01.1080p", 1400<<20),
+		rssItem("Show B 1x01", 300<<20),
+		rssItem("Show.A.S01E02.720p.CAM", 700<<20),
+		rssItem("Something else", 700<<20),
+	))
+
+	e := enginetest.New()
+	f, _, cleanup := newTestFeeds(t, e, s.URL+"/rss")
+	defer cleanup()
+	err := f.setRule(FeedRule{Name: "shows", Include: `^show`, Exclude: `\bcam\b`, Episodes: true, Tags: []string{"tv"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.poll(true)
+	//the 1080p one is an episode already added, Show B one of another show
+	expectAdded(t, e, "Show.A.S01E01.720p", "Show B 1x01")
+	for _, tr := range e.GetTorrents() {
+		if len(tr.Tags) != 1 || tr.Tags[0] != "tv" {
+			t.Errorf("expected tag tv on %s, got %v", tr.Name, tr.Tags)
+		}
+	}
+	feeds, _ := f.list()
+	if feeds[0].LastError != "" || feeds[0].LastPolled.IsZero() {
+		t.Errorf("unexpected poll state %+v", feeds[0])
+	}
+}
+
+func TestFeedAtom(t *testing.T) {
+	s := newFeedServer()
+	defer s.Close()
+	s.serve("/atom", atom(
+		atomEntry("Small", 10<<20),
+		atomEntry("Medium", 500<<20),
+		atomEntry("Large", 5<<30),
+	))
+
+	e := enginetest.New()
+	f, _, cleanup := newTestFeeds(t, e, s.URL+"/atom")
+	defer cleanup()
+	if err := f.setRule(FeedRule{Name: "sized", MinSize: 100 << 20, MaxSize: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.poll(true)
+	expectAdded(t, e, "Medium")
+}
+
+func TestFeedSeenReload(t *testing.T) {
+	s := newFeedServer()
+	defer s.Close()
+	s.serve("/rss", rss(rssItem("Show.S01E01", 100), rssItem("Other", 100)))
+
+	e := enginetest.New()
+	f, path, cleanup := newTestFeeds(t, e, s.URL+"/rss")
+	defer cleanup()
+	if err := f.setRule(FeedRule{Name: "shows", Include: "show", Episodes: true}); err != nil {
+		t.Fatal(err)
+	}
+	f.poll(true)
+	expectAdded(t, e, "Show.S01E01")
+
+	//items that were handled, added or not, stay handled after a restart
+	e = enginetest.New()
+	f, err := newFeeds(path, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Seen) != 2 {
+		t.Fatalf("expected 2 seen items, got %v", f.Seen)
+	}
+	if err := f.setRule(FeedRule{Name: "all"}); err != nil {
+		t.Fatal(err)
+	}
+	f.poll(true)
+	expectAdded(t, e)
+
+	s.serve("/rss", rss(rssItem("Show.S01E01", 100), rssItem("Other", 100), rssItem("Show.S01E01.Repack", 100)))
+	if err := f.removeRule("all"); err != nil {
+		t.Fatal(err)
+	}
+	f.poll(true)
+	//the episode was added before the restart
+	expectAdded(t, e)
+}
+
+func TestFeedRetry(t *testing.T) {
+	s := newFeedServer()
+	defer s.Close()
+	item := func(title string) string {
+		return fmt.Sprintf(`<item><title>%s</title><link>%s/%s.torrent</link></item>`, title, s.URL, title)
+	}
+	s.serve("/rss", rss(item("Late"), item("Missing")))
+
+	e := enginetest.New()
+	f, _, cleanup := newTestFeeds(t, e, s.URL+"/rss")
+	defer cleanup()
+	if err := f.setRule(FeedRule{Name: "all"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//neither .torrent is there yet
+	f.poll(true)
+	expectAdded(t, e)
+
+	s.serve("/Late.torrent", []byte("d4:infod6:lengthi10e4:name4:Late12:piece lengthi16384e6:pieces20:"+strings.Repeat("x", 20)+"ee"))
+	f.poll(true)
+	expectAdded(t, e, "Late")
+
+	//attempted on every poll, twice so far, until given up on
+	for attempts := 2; attempts < maxFeedAddAttempts-1; attempts++ {
+		f.poll(true)
+	}
+	missing := s.URL + "/rss#" + s.URL + "/Missing.torrent"
+	if _, ok := f.Seen[missing]; ok || f.Retries[missing].Attempts != maxFeedAddAttempts-1 {
+		t.Fatalf("expected %d attempts, got %+v", maxFeedAddAttempts-1, f.Retries[missing])
+	}
+	f.poll(true)
+	if _, ok := f.Seen[missing]; !ok {
+		t.Fatalf("not given up on after %d attempts", maxFeedAddAttempts)
+	}
+	if len(f.Retries) != 0 {
+		t.Errorf("unexpected retries %v", f.Retries)
+	}
+}
+
+func TestEpisodeOf(t *testing.T) {
+	for title, episode := range map[string]string{
+		"Show.Name.S01E02.720p":   "show name s01e02",
+		"Show Name - s1e2":        "show name s01e02",
+		"show_name 1x02 [HDTV]":   "show name s01e02",
+		"Other.Show.S01E02":       "other show s01e02",
+		"S03E10":                  "s03e10",
+		"Show.Name.2018.Complete": "",
+	} {
+		if got := episodeOf(title); got != episode {
+			t.Errorf("episode of %s: expected %q, got %q", title, episode, got)
+		}
+	}
+}
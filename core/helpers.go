@@ -2,8 +2,12 @@ package core
 
 import (
 	"errors"
+	"fmt"
 	"github.com/labstack/echo"
+	"github.com/pooflix/engine"
 	"net"
+	"strconv"
+	"time"
 )
 
 type CustomContext struct {
@@ -18,6 +22,107 @@ func routeHandler(fn func(*CustomContext) error) echo.HandlerFunc {
 	}
 }
 
+// formInt64 parses form value of key, def is returned when value is missing
+func formInt64(ctx *CustomContext, key string, def int64) (int64, error) {
+	v := ctx.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+
+	return n, nil
+}
+
+// formFloat32 parses form value of key, def is returned when value is missing
+func formFloat32(ctx *CustomContext, key string, def float32) (float32, error) {
+	v := ctx.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+
+	return float32(f), nil
+}
+
+// formDuration parses form value of key, def is returned when value is missing
+func formDuration(ctx *CustomContext, key string, def time.Duration) (time.Duration, error) {
+	v := ctx.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+
+	return d, nil
+}
+
+// formAddOptions reads category, tag, paused and ephemeral form values a torrent is added with
+func formAddOptions(ctx *CustomContext) (engine.AddOptions, error) {
+	params, err := ctx.FormParams()
+	if err != nil {
+		return engine.AddOptions{}, err
+	}
+
+	o := engine.AddOptions{
+		Category: params.Get("category"),
+		Tags:     params["tag"],
+	}
+
+	if v := params.Get("paused"); v != "" {
+		if o.Paused, err = strconv.ParseBool(v); err != nil {
+			return o, fmt.Errorf("invalid paused: %v", err)
+		}
+	}
+
+	if v := params.Get("ephemeral"); v != "" {
+		if o.Ephemeral, err = strconv.ParseBool(v); err != nil {
+			return o, fmt.Errorf("invalid ephemeral: %v", err)
+		}
+	}
+
+	return o, nil
+}
+
+// filterTorrents keeps torrents of category, when not empty, that have all tags
+func filterTorrents(ts map[string]*engine.Torrent, category string, tags []string) map[string]*engine.Torrent {
+	filtered := map[string]*engine.Torrent{}
+	for ih, t := range ts {
+		if category != "" && t.Category != category {
+			continue
+		}
+
+		has := map[string]bool{}
+		for _, tag := range t.Tags {
+			has[tag] = true
+		}
+
+		matches := true
+		for _, tag := range tags {
+			if !has[tag] {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			filtered[ih] = t
+		}
+	}
+
+	return filtered
+}
+
 func GetLocalIp() (string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
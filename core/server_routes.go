@@ -1,33 +1,698 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/labstack/echo"
+	"github.com/pooflix/engine"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+// maxTorrentUpload is the largest form a .torrent file is
+// uploaded with, room for the file and a few form values
+const maxTorrentUpload = maxFeedTorrentSize + 1<<20
+
 func routes(e *echo.Echo) {
 	api := e.Group("/api/v1")
 
-	// endpoint to start download torrent from magnet link
+	// endpoint to start download torrent from magnet link, optionally with category, tags and paused state
 	api.POST("/torrents/magnet", routeHandler(func(ctx *CustomContext) error {
 		c := ctx.Core
 		link := ctx.FormValue("link")
 
-		if err := c.engine.NewMagnet(link); err != nil {
+		o, err := formAddOptions(ctx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.NewMagnet(link, o); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to start download torrent from uploaded .torrent file, optionally with category, tags and paused state
+	api.POST("/torrents/file", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		//the form is spooled to disk while parsed, before the file is looked at
+		req := ctx.Request()
+		if req.ContentLength > maxTorrentUpload {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge)
+		}
+		req.Body = http.MaxBytesReader(ctx.Response(), req.Body, maxTorrentUpload)
+		fh, err := ctx.FormFile("torrent")
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if fh.Size > maxFeedTorrentSize {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge)
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		defer f.Close()
+
+		spec, err := engine.LoadTorrentSpec(io.LimitReader(f, maxFeedTorrentSize))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		o, err := formAddOptions(ctx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.NewTorrent(spec, o); err != nil {
 			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
 		}
 
 		return echo.NewHTTPError(http.StatusAccepted)
 	}))
 
-	// endpoint of torrents in pooflix
+	// endpoint to create torrent from file or directory in download directory and start seeding it, needs seeding enabled
+	api.POST("/torrents/create", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		pieceLength, err := formInt64(ctx, "piece_length", 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		private := false
+		if v := ctx.FormValue("private"); v != "" {
+			if private, err = strconv.ParseBool(v); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		params, err := ctx.FormParams()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		created, err := c.engine.CreateTorrent(engine.CreateOptions{
+			Path:        ctx.FormValue("path"),
+			PieceLength: pieceLength,
+			Trackers:    params["tracker"],
+			WebSeeds:    params["webseed"],
+			Private:     private,
+			Comment:     ctx.FormValue("comment"),
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return ctx.JSON(http.StatusCreated, created)
+	}))
+
+	// endpoint to download .torrent file of torrent
+	api.GET("/torrents/:hash/metainfo", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		hash := ctx.Param("hash")
+
+		if t, err := c.engine.GetTorrent(hash); err == nil {
+			b, err := c.engine.Metainfo(hash)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			}
+
+			ctx.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", t.Name+".torrent"))
+			return ctx.Blob(http.StatusOK, "application/x-bittorrent", b)
+		}
+
+		return echo.ErrNotFound
+	}))
+
+	// endpoint of torrents in pooflix, filtered by category and tags, e.g. ?category=movies&tag=hd&tag=new
 	api.GET("/torrents", routeHandler(func(ctx *CustomContext) error {
 		c := ctx.Core
-		return ctx.JSON(http.StatusOK, c.engine.GetTorrents())
+		ts := c.engine.GetTorrents()
+
+		if category, tags := ctx.QueryParam("category"), ctx.QueryParams()["tag"]; category != "" || len(tags) > 0 {
+			ts = filterTorrents(ts, category, tags)
+		}
+
+		return ctx.JSON(http.StatusOK, ts)
+	}))
+
+	// endpoint of categories
+	api.GET("/categories", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		return ctx.JSON(http.StatusOK, c.engine.Categories())
+	}))
+
+	// endpoint to create or change category, with save path and default download limit
+	api.PUT("/categories/:name", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		download, err := formInt64(ctx, "download_limit", 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if ctx.FormValue("upload_limit") != "" {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "uploads only have the global limit")
+		}
+
+		if err := c.engine.SetCategory(engine.Category{
+			Name:          ctx.Param("name"),
+			SavePath:      ctx.FormValue("save_path"),
+			DownloadLimit: download,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to remove category, its torrents are left without category
+	api.DELETE("/categories/:name", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.RemoveCategory(ctx.Param("name")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to change category of torrent, empty category removes it
+	api.PUT("/torrents/:hash/category", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.SetTorrentCategory(ctx.Param("hash"), ctx.FormValue("category")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to replace tags of torrent, one tag field per tag
+	api.PUT("/torrents/:hash/tags", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		params, err := ctx.FormParams()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.SetTorrentTags(ctx.Param("hash"), params["tag"]); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint of followed feeds and their rules
+	api.GET("/feeds", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		feeds, rules := c.feeds.list()
+		return ctx.JSON(http.StatusOK, map[string]interface{}{
+			"feeds": feeds,
+			"rules": rules,
+		})
+	}))
+
+	// endpoint to follow feed, polled every interval (e.g. 30m)
+	api.POST("/feeds", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.feeds.addFeed(ctx.FormValue("url"), ctx.FormValue("interval")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to stop following feed
+	api.DELETE("/feeds", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.feeds.removeFeed(ctx.QueryParam("url")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to poll every feed now
+	api.POST("/feeds/poll", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		go c.feeds.poll(true)
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to create or change rule adding feed items, with include and
+	// exclude expressions, size bounds and options items are added with
+	api.PUT("/feeds/rules/:name", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		o, err := formAddOptions(ctx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		min, err := formInt64(ctx, "min_size", 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		max, err := formInt64(ctx, "max_size", 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		episodes := false
+		if v := ctx.FormValue("episodes"); v != "" {
+			if episodes, err = strconv.ParseBool(v); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid episodes: %v", err))
+			}
+		}
+
+		if err := c.feeds.setRule(FeedRule{
+			Name:     ctx.Param("name"),
+			Feed:     ctx.FormValue("feed"),
+			Include:  ctx.FormValue("include"),
+			Exclude:  ctx.FormValue("exclude"),
+			MinSize:  min,
+			MaxSize:  max,
+			Episodes: episodes,
+			Category: o.Category,
+			Tags:     o.Tags,
+			Paused:   o.Paused,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to remove rule
+	api.DELETE("/feeds/rules/:name", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.feeds.removeRule(ctx.Param("name")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to remove torrent, with data=true its files are deleted as well
+	api.DELETE("/torrents/:hash", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		data := false
+		if v := ctx.QueryParam("data"); v != "" {
+			var err error
+			if data, err = strconv.ParseBool(v); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid data: %v", err))
+			}
+		}
+
+		if _, err := c.engine.GetTorrent(ctx.Param("hash")); err != nil {
+			return echo.ErrNotFound
+		}
+
+		if err := c.engine.DeleteTorrent(ctx.Param("hash"), data); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to pause torrent, peers are disconnected but torrent stays loaded
+	api.POST("/torrents/:hash/pause", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.PauseTorrent(ctx.Param("hash")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to resume paused torrent
+	api.POST("/torrents/:hash/resume", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.ResumeTorrent(ctx.Param("hash")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to change priority of file, one of skip, normal, high or now
+	api.PUT("/torrents/:hash/files/:id/priority", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		hash := ctx.Param("hash")
+		id, err := strconv.Atoi(ctx.Param("id"))
+
+		if t, terr := c.engine.GetTorrent(hash); err == nil && terr == nil && id >= 0 && len(t.Files) > id {
+			p, err := engine.ParsePriority(ctx.FormValue("priority"))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			if err := c.engine.SetFilePriority(hash, t.Files[id].Path, p); err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			}
+
+			return echo.NewHTTPError(http.StatusAccepted)
+		}
+
+		return echo.ErrNotFound
+	}))
+
+	// endpoint of current engine config
+	api.GET("/config", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		return ctx.JSON(http.StatusOK, c.engine.Config())
+	}))
+
+	// endpoint to reconfigure engine, missing fields keep their value and torrents are carried over
+	api.PUT("/config", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		ec := c.engine.Config()
+
+		if err := ctx.Bind(&ec); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.reconfigure(ec); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return ctx.JSON(http.StatusOK, c.engine.Config())
+	}))
+
+	// endpoint to change default global rate limits in bytes per second, 0 is unlimited
+	api.PUT("/limits", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		cfg := c.engine.Config()
+
+		download, err := formInt64(ctx, "download", cfg.DownloadRate)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		upload, err := formInt64(ctx, "upload", cfg.UploadRate)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.SetRateLimits(download, upload); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint of free disk space, quota and whether downloads are held back for low space or exceeded quota
+	api.GET("/disk", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		disk, err := c.engine.DiskSpace()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return ctx.JSON(http.StatusOK, disk)
+	}))
+
+	// endpoint to turn alternative speed on or off, it applies instead of scheduled profiles
+	api.PUT("/limits/alternative", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		on, err := strconv.ParseBool(ctx.FormValue("enabled"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid enabled: %v", err))
+		}
+
+		if err := c.engine.SetAltSpeed(on); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to override global download limit for single torrent, 0 falls back to global limit,
+	// uploads only have the global limit
+	api.PUT("/torrents/:hash/limits", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		hash := ctx.Param("hash")
+
+		if ctx.FormValue("upload") != "" {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "uploads only have the global limit")
+		}
+
+		if t, err := c.engine.GetTorrent(hash); err == nil {
+			download, err := formInt64(ctx, "download", t.DownloadLimit)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			if err := c.engine.SetTorrentRateLimits(hash, download); err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			}
+
+			return echo.NewHTTPError(http.StatusAccepted)
+		}
+
+		return echo.ErrNotFound
+	}))
+
+	// endpoint to change global seeding goals, ratio and time (e.g. 48h) after which torrents are paused
+	api.PUT("/seeding", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		cfg := c.engine.Config()
+
+		ratio, err := formFloat32(ctx, "ratio", cfg.SeedRatio)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		seedTime, err := formDuration(ctx, "time", cfg.SeedTime)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.SetSeedingGoals(ratio, seedTime); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to override global seeding goals for single torrent
+	api.PUT("/torrents/:hash/seeding", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		hash := ctx.Param("hash")
+
+		if t, err := c.engine.GetTorrent(hash); err == nil {
+			ratio, err := formFloat32(ctx, "ratio", t.SeedRatio)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			seedTime, err := formDuration(ctx, "time", t.SeedTime)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			if err := c.engine.SetTorrentSeedingGoals(hash, ratio, seedTime); err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			}
+
+			return echo.NewHTTPError(http.StatusAccepted)
+		}
+
+		return echo.ErrNotFound
+	}))
+
+	// endpoint to change how many torrents download and seed at the same time, 0 is unlimited
+	api.PUT("/queue", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		cfg := c.engine.Config()
+
+		downloads, err := formInt64(ctx, "downloads", int64(cfg.MaxActiveDownloads))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		seeds, err := formInt64(ctx, "seeds", int64(cfg.MaxActiveSeeds))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.SetQueueLimits(int(downloads), int(seeds)); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to move torrent in queue, one of up, down, top or bottom
+	api.POST("/torrents/:hash/queue/:move", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.MoveInQueue(ctx.Param("hash"), ctx.Param("move")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint streaming engine events as server-sent events, piece events only with ?pieces=true
+	api.GET("/events", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		pieces := ctx.QueryParam("pieces") == "true"
+		events, cancel := c.engine.Subscribe()
+		defer cancel()
+
+		res := ctx.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(http.StatusOK)
+		res.Flush()
+
+		for {
+			select {
+			case <-ctx.Request().Context().Done():
+				return nil
+			case ev := <-events:
+				if ev.Type == engine.EventPieceCompleted && !pieces {
+					continue
+				}
+
+				data, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+
+				if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+					return nil
+				}
+				res.Flush()
+			}
+		}
+	}))
+
+	// endpoint of trackers of torrent and their announce status
+	api.GET("/torrents/:hash/trackers", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		trackers, err := c.engine.Trackers(ctx.Param("hash"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+
+		return ctx.JSON(http.StatusOK, trackers)
+	}))
+
+	// endpoint to add tracker to torrent, without tier it gets a tier of its own
+	api.POST("/torrents/:hash/trackers", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		tier, err := formInt64(ctx, "tier", -1)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.AddTracker(ctx.Param("hash"), ctx.FormValue("url"), int(tier)); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to remove tracker from torrent
+	api.DELETE("/torrents/:hash/trackers", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.RemoveTracker(ctx.Param("hash"), ctx.QueryParam("url")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to announce torrent to all its trackers right away
+	api.POST("/torrents/:hash/reannounce", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.Reannounce(ctx.Param("hash")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to hash all pieces of torrent again, pieces that fail are downloaded again
+	api.POST("/torrents/:hash/recheck", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.RecheckTorrent(ctx.Param("hash")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to move data of torrent to path relative to storage root, seeding continues from there
+	api.PUT("/torrents/:hash/storage", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		if err := c.engine.MoveStorage(ctx.Param("hash"), ctx.FormValue("path")); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to switch sequential download of whole torrent for streaming
+	api.PUT("/torrents/:hash/streaming", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+
+		on, err := strconv.ParseBool(ctx.FormValue("enabled"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := c.engine.SetTorrentStreaming(ctx.Param("hash"), on); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusAccepted)
+	}))
+
+	// endpoint to switch sequential download of single file for streaming
+	api.PUT("/torrents/:hash/files/:id/streaming", routeHandler(func(ctx *CustomContext) error {
+		c := ctx.Core
+		hash := ctx.Param("hash")
+		id, err := strconv.Atoi(ctx.Param("id"))
+
+		if t, terr := c.engine.GetTorrent(hash); err == nil && terr == nil && id >= 0 && len(t.Files) > id {
+			on, err := strconv.ParseBool(ctx.FormValue("enabled"))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			if err := c.engine.SetFileStreaming(hash, t.Files[id].Path, on); err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			}
+
+			return echo.NewHTTPError(http.StatusAccepted)
+		}
+
+		return echo.ErrNotFound
 	}))
 
 	// endpoint for generation m3u8 file list of streams
@@ -35,7 +700,7 @@ func routes(e *echo.Echo) {
 		c := ctx.Core
 		hash := ctx.Param("hash")
 
-		if t, ok := c.engine.GetTorrents()[hash]; ok {
+		if t, err := c.engine.GetTorrent(hash); err == nil {
 			ctx.Response().Header().Set(echo.HeaderContentType, "application/x-mpegurl; charset=utf-8")
 
 			ip, err := GetLocalIp()
@@ -61,10 +726,12 @@ func routes(e *echo.Echo) {
 		hash := ctx.Param("hash")
 		id, err := strconv.Atoi(ctx.Param("id"))
 
-		if t, ok := c.engine.GetTorrents()[hash]; err == nil && ok && len(t.Files) > id {
-			rr := t.Files[id].GetFile()
-			entry := rr.NewReader()
+		if err != nil {
+			return echo.ErrNotFound
+		}
 
+		// reader lets the engine keep the pieces ahead of the playhead prioritized
+		if entry, err := c.engine.NewFileReader(hash, id); err == nil {
 			defer func() {
 				if err := entry.Close(); err != nil {
 					log.Printf("Error closing file reader: %s\n", err)
@@ -75,7 +742,7 @@ func routes(e *echo.Echo) {
 			ctx.Response().Header().Set("transferMode.dlna.org", "Streaming")
 			ctx.Response().Header().Set("contentFeatures.dlna.org", "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000")
 
-			http.ServeContent(ctx.Response(), ctx.Request(), rr.Path(), time.Now(), entry)
+			http.ServeContent(ctx.Response(), ctx.Request(), entry.File().Path, time.Now(), entry)
 			return nil
 		}
 
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pooflix/engine"
+	"github.com/pooflix/engine/enginetest"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// serve runs a request against h, form values are sent url encoded
+func serve(h http.Handler, method, target string, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+}
+
+func listTorrents(t *testing.T, h http.Handler) map[string]engine.Torrent {
+	t.Helper()
+	rec := serve(h, "GET", "/api/v1/torrents", nil, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var ts map[string]engine.Torrent
+	if err := json.Unmarshal(rec.Body.Bytes(), &ts); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestAddMagnet(t *testing.T) {
+	h := NewHandler(&Config{}, enginetest.New())
+	ih := enginetest.InfoHash("show")
+
+	rec := serve(h, "POST", "/api/v1/torrents/magnet", url.Values{
+		"link": {"magnet:?xt=urn:btih:" + ih + "&dn=show"},
+		"tag":  {"hd"},
+	}, nil)
+	expectStatus(t, rec, http.StatusAccepted)
+
+	ts := listTorrents(t, h)
+	if len(ts) != 1 || ts[ih].Name != "show" {
+		t.Fatalf("expected torrent show, got %+v", ts)
+	}
+	if tags := ts[ih].Tags; len(tags) != 1 || tags[0] != "hd" {
+		t.Errorf("expected tag hd, got %v", tags)
+	}
+
+	rec = serve(h, "POST", "/api/v1/torrents/magnet", url.Values{"link": {"not a magnet"}}, nil)
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+}
+
+func TestListTorrentsFiltered(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+	if err := e.SetCategory(engine.Category{Name: "movies"}); err != nil {
+		t.Fatal(err)
+	}
+	e.AddTorrent("a", 10)
+	ih, _ := e.AddTorrent("b", 10)
+	if err := e.SetTorrentCategory(ih, "movies"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts := listTorrents(t, h); len(ts) != 2 {
+		t.Fatalf("expected 2 torrents, got %d", len(ts))
+	}
+	rec := serve(h, "GET", "/api/v1/torrents?category=movies", nil, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var ts map[string]engine.Torrent
+	if err := json.Unmarshal(rec.Body.Bytes(), &ts); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ts[ih]; len(ts) != 1 || !ok {
+		t.Fatalf("expected only torrent b, got %+v", ts)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+	ih, err := e.AddTorrent("show", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, serve(h, "POST", "/api/v1/torrents/"+ih+"/pause", nil, nil), http.StatusAccepted)
+	if !listTorrents(t, h)[ih].Paused {
+		t.Fatal("torrent not paused")
+	}
+	expectStatus(t, serve(h, "POST", "/api/v1/torrents/"+ih+"/pause", nil, nil), http.StatusUnprocessableEntity)
+
+	expectStatus(t, serve(h, "POST", "/api/v1/torrents/"+ih+"/resume", nil, nil), http.StatusAccepted)
+	if listTorrents(t, h)[ih].Paused {
+		t.Fatal("torrent still paused")
+	}
+	expectStatus(t, serve(h, "POST", "/api/v1/torrents/"+ih+"/resume", nil, nil), http.StatusUnprocessableEntity)
+}
+
+func TestFilePriority(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+	ih, err := e.AddTorrent("show", 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(h, "PUT", "/api/v1/torrents/"+ih+"/files/1/priority", url.Values{"priority": {"skip"}}, nil)
+	expectStatus(t, rec, http.StatusAccepted)
+	files := listTorrents(t, h)[ih].Files
+	if files[0].Priority != engine.PriorityNormal || files[1].Priority != engine.PrioritySkip {
+		t.Fatalf("expected priorities normal and skip, got %s and %s", files[0].Priority, files[1].Priority)
+	}
+
+	rec = serve(h, "PUT", "/api/v1/torrents/"+ih+"/files/1/priority", url.Values{"priority": {"urgent"}}, nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+	rec = serve(h, "PUT", "/api/v1/torrents/"+ih+"/files/2/priority", url.Values{"priority": {"high"}}, nil)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestStreamRange(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+	ih, err := e.AddTorrent("movie", 1000, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := enginetest.Content("movie/1.bin", 5000)
+
+	rec := serve(h, "GET", "/api/v1/torrents/"+ih+"/stream/1", nil, http.Header{"Range": {"bytes=100-1099"}})
+	expectStatus(t, rec, http.StatusPartialContent)
+	if got := rec.Header().Get("Content-Range"); got != "bytes 100-1099/5000" {
+		t.Errorf("unexpected content range %s", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), content[100:1100]) {
+		t.Error("ranged stream differs from the file content")
+	}
+
+	rec = serve(h, "GET", "/api/v1/torrents/"+ih+"/stream/1", nil, nil)
+	expectStatus(t, rec, http.StatusOK)
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Error("stream differs from the file content")
+	}
+
+	expectStatus(t, serve(h, "GET", "/api/v1/torrents/"+ih+"/stream/2", nil, nil), http.StatusNotFound)
+}
+
+func TestCreateTorrent(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+
+	rec := serve(h, "POST", "/api/v1/torrents/create", url.Values{"path": {"shared"}}, nil)
+	expectStatus(t, rec, http.StatusCreated)
+	var created engine.CreatedTorrent
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.InfoHash != enginetest.InfoHash("shared") {
+		t.Errorf("unexpected infohash %s", created.InfoHash)
+	}
+
+	//a created torrent is refused while it could not be seeded
+	c := e.Config()
+	c.EnableSeeding = false
+	if err := e.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(h, "POST", "/api/v1/torrents/create", url.Values{"path": {"other"}}, nil)
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+}
+
+func TestTorrentLimits(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+	ih, err := e.AddTorrent("show", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRateLimits(2000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(h, "PUT", "/api/v1/torrents/"+ih+"/limits", url.Values{"download": {"500"}}, nil)
+	expectStatus(t, rec, http.StatusAccepted)
+	tr := listTorrents(t, h)[ih]
+	if tr.EffectiveDownloadLimit != 500 || tr.EffectiveUploadLimit != 1000 {
+		t.Fatalf("expected limits 500 and 1000, got %d and %d", tr.EffectiveDownloadLimit, tr.EffectiveUploadLimit)
+	}
+
+	//uploads only have the global limit
+	rec = serve(h, "PUT", "/api/v1/torrents/"+ih+"/limits", url.Values{"upload": {"100"}}, nil)
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+}
+
+// uploadTorrent posts b as the .torrent file of the form
+func uploadTorrent(h http.Handler, b []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fw, _ := w.CreateFormFile("torrent", "upload.torrent")
+	fw.Write(b)
+	w.Close()
+	req := httptest.NewRequest("POST", "/api/v1/torrents/file", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUploadTorrent(t *testing.T) {
+	e := enginetest.New()
+	h := NewHandler(&Config{}, e)
+
+	rec := uploadTorrent(h, []byte("d4:infod6:lengthi10e4:name6:Upload12:piece lengthi16384e6:pieces20:"+strings.Repeat("x", 20)+"ee"))
+	expectStatus(t, rec, http.StatusAccepted)
+	expectAdded(t, e, "Upload")
+
+	rec = uploadTorrent(h, make([]byte, maxFeedTorrentSize+1))
+	expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+	rec = uploadTorrent(h, make([]byte, maxTorrentUpload+1))
+	expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+	expectAdded(t, e, "Upload")
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pooflix/engine"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchInterval is how often the watch directory is scanned, files
+// modified more recently than that may still be written to
+const watchInterval = 5 * time.Second
+
+// subfolders of the watch directory files are moved into
+const (
+	watchProcessed = "processed"
+	watchFailed    = "failed"
+)
+
+// watcher adds the .torrent and .magnet files dropped into
+// a directory, moving each into a subfolder afterwards
+type watcher struct {
+	dir     string
+	options engine.AddOptions
+	engine  TorrentEngine
+}
+
+func newWatcher(dir string, o engine.AddOptions, e TorrentEngine) (*watcher, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range []string{watchProcessed, watchFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &watcher{dir: dir, options: o, engine: e}, nil
+}
+
+func (w *watcher) run() {
+	for range time.Tick(watchInterval) {
+		w.scan()
+	}
+}
+
+func (w *watcher) scan() {
+	f, err := os.Open(w.dir)
+	if err != nil {
+		log.Printf("Core: can't read watch directory, %v", err)
+		return
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		log.Printf("Core: can't read watch directory, %v", err)
+		return
+	}
+
+	for _, fi := range entries {
+		ext := strings.ToLower(filepath.Ext(fi.Name()))
+		if !fi.Mode().IsRegular() || (ext != ".torrent" && ext != ".magnet") {
+			continue
+		}
+
+		if time.Since(fi.ModTime()) < watchInterval {
+			continue
+		}
+
+		path := filepath.Join(w.dir, fi.Name())
+		sub := watchProcessed
+		if err := w.add(path, ext); err != nil {
+			log.Printf("Core: can't add %s from watch directory, %v", fi.Name(), err)
+			sub = watchFailed
+		}
+
+		if err := moveInto(path, filepath.Join(w.dir, sub)); err != nil {
+			log.Printf("Core: can't move %s out of watch directory, %v", fi.Name(), err)
+		}
+	}
+}
+
+func (w *watcher) add(path, ext string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if ext == ".torrent" {
+		spec, err := engine.LoadTorrentSpec(f)
+		if err != nil {
+			return err
+		}
+
+		return w.engine.NewTorrent(spec, w.options)
+	}
+
+	//first line holding a magnet link
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "magnet:") {
+			return w.engine.NewMagnet(line, w.options)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("no magnet link found")
+}
+
+// moveInto moves file at path into dir, a file of the same name
+// already there is kept by suffixing the moved one with the time
+func moveInto(path, dir string) error {
+	target := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(target)
+		target = strings.TrimSuffix(target, ext) + "." + strconv.FormatInt(time.Now().Unix(), 10) + ext
+	}
+
+	return os.Rename(path, target)
+}
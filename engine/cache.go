@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultStreamCacheSize is the cache of an ephemeral
+// torrent when Config leaves it unset
+const defaultStreamCacheSize = 256 << 20
+
+// minCachePieces is how many pieces a cache holds at least,
+// whatever its size, pieces are downloaded a few at a time
+const minCachePieces = 8
+
+// pieceCache is the storage of an ephemeral torrent, it keeps a bounded
+// number of pieces in memory or in a single file. Once full, pieces behind
+// the playhead are evicted first, then the least recently used one.
+// anacrolix finds out about evicted pieces when reading them fails,
+// and downloads them again.
+type pieceCache struct {
+	mut      sync.Mutex
+	capacity int64
+	//file the pieces are kept in, empty keeps them in memory
+	path        string
+	file        *os.File
+	pieceLength int64
+	//memory of every slot, when kept in memory
+	slots  [][]byte
+	free   []int
+	pieces map[int]*cachedPiece
+	//lowest piece any reader is at, -1 when nobody reads
+	playhead int
+	clock    int64
+}
+
+type cachedPiece struct {
+	slot     int
+	complete bool
+	//clock of the last read or write
+	used int64
+}
+
+// newCache returns a cache for the ephemeral torrent ih
+func (e *Engine) newCache(ih metainfo.Hash) *pieceCache {
+	e.mut.Lock()
+	size := e.config.StreamCacheSize
+	path := ""
+	if e.config.StreamCacheFile {
+		path = filepath.Join(e.cacheDir, "cache", ih.HexString())
+	}
+	e.mut.Unlock()
+	if size <= 0 {
+		size = defaultStreamCacheSize
+	}
+	return &pieceCache{capacity: size, path: path, playhead: -1}
+}
+
+// torrentCache is the cache of an ephemeral torrent, nil for others
+func (e *Engine) torrentCache(infohash string) *pieceCache {
+	e.storageMut.Lock()
+	defer e.storageMut.Unlock()
+	return e.caches[infohash]
+}
+
+// removeCache forgets the cache of a torrent taken off the client
+func (e *Engine) removeCache(infohash string) {
+	e.storageMut.Lock()
+	defer e.storageMut.Unlock()
+	delete(e.caches, infohash)
+}
+
+func (c *pieceCache) OpenTorrent(info *metainfo.Info, ih metainfo.Hash) (storage.TorrentImpl, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.pieceLength = info.PieceLength
+	n := int(c.capacity / c.pieceLength)
+	if n < minCachePieces {
+		n = minCachePieces
+	}
+	if c.path != "" {
+		if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		c.file = f
+	} else {
+		c.slots = make([][]byte, n)
+	}
+	c.free = make([]int, n)
+	for i := range c.free {
+		c.free[i] = n - 1 - i
+	}
+	c.pieces = map[int]*cachedPiece{}
+	return cacheTorrent{c}, nil
+}
+
+// Close leaves nothing to close, the data goes along with the torrent
+func (c *pieceCache) Close() error {
+	return nil
+}
+
+// setPlayhead tells the cache where playback is
+func (c *pieceCache) setPlayhead(piece int) {
+	c.mut.Lock()
+	c.playhead = piece
+	c.mut.Unlock()
+}
+
+// discard drops every piece, removing the cache file
+func (c *pieceCache) discard() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.slots = nil
+	c.free = nil
+	c.pieces = map[int]*cachedPiece{}
+	if c.file == nil {
+		return nil
+	}
+	c.file.Close()
+	c.file = nil
+	return os.Remove(c.path)
+}
+
+// piece returns the cached piece i, a slot is taken for it when
+// alloc is set, evicting another piece if need be. c.mut must be held.
+func (c *pieceCache) piece(i int, alloc bool) *cachedPiece {
+	c.clock++
+	if p, ok := c.pieces[i]; ok {
+		p.used = c.clock
+		return p
+	}
+	if !alloc {
+		return nil
+	}
+	if len(c.free) == 0 {
+		if !c.evict(i) {
+			return nil
+		}
+	}
+	slot := c.free[len(c.free)-1]
+	c.free = c.free[:len(c.free)-1]
+	p := &cachedPiece{slot: slot, used: c.clock}
+	c.pieces[i] = p
+	return p
+}
+
+// evict frees the slot of the least recently used piece behind
+// the playhead or else of any piece but keep. c.mut must be held.
+func (c *pieceCache) evict(keep int) bool {
+	victim, behind := -1, false
+	for i, p := range c.pieces {
+		if i == keep {
+			continue
+		}
+		b := c.playhead >= 0 && i < c.playhead
+		switch {
+		case victim < 0,
+			b && !behind,
+			b == behind && p.used < c.pieces[victim].used:
+			victim, behind = i, b
+		}
+	}
+	if victim < 0 {
+		return false
+	}
+	c.free = append(c.free, c.pieces[victim].slot)
+	delete(c.pieces, victim)
+	return true
+}
+
+func (c *pieceCache) readAt(i int, b []byte, off int64) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	p := c.piece(i, false)
+	if p == nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if c.file != nil {
+		return c.file.ReadAt(b, int64(p.slot)*c.pieceLength+off)
+	}
+	slot := c.slots[p.slot]
+	if off >= int64(len(slot)) {
+		return 0, io.EOF
+	}
+	n := copy(b, slot[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *pieceCache) writeAt(i int, b []byte, off int64) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	p := c.piece(i, true)
+	if p == nil {
+		return 0, io.ErrShortWrite
+	}
+	if c.file != nil {
+		return c.file.WriteAt(b, int64(p.slot)*c.pieceLength+off)
+	}
+	if c.slots[p.slot] == nil {
+		c.slots[p.slot] = make([]byte, c.pieceLength)
+	}
+	slot := c.slots[p.slot]
+	if off+int64(len(b)) > int64(len(slot)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(slot[off:], b), nil
+}
+
+func (c *pieceCache) setComplete(i int, complete bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if p, ok := c.pieces[i]; ok {
+		p.complete = complete
+	}
+}
+
+func (c *pieceCache) complete(i int) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	p, ok := c.pieces[i]
+	return ok && p.complete
+}
+
+type cacheTorrent struct {
+	c *pieceCache
+}
+
+func (t cacheTorrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return cachePiece{t.c, p.Index()}
+}
+
+// Close discards the data, the torrent got dropped
+func (t cacheTorrent) Close() error {
+	return t.c.discard()
+}
+
+type cachePiece struct {
+	c *pieceCache
+	i int
+}
+
+func (p cachePiece) ReadAt(b []byte, off int64) (int, error) {
+	return p.c.readAt(p.i, b, off)
+}
+
+func (p cachePiece) WriteAt(b []byte, off int64) (int, error) {
+	return p.c.writeAt(p.i, b, off)
+}
+
+func (p cachePiece) MarkComplete() error {
+	p.c.setComplete(p.i, true)
+	return nil
+}
+
+func (p cachePiece) MarkNotComplete() error {
+	p.c.setComplete(p.i, false)
+	return nil
+}
+
+func (p cachePiece) Completion() storage.Completion {
+	return storage.Completion{Complete: p.c.complete(p.i), Ok: true}
+}
@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"bytes"
+	"github.com/anacrolix/torrent/metainfo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPieceLength = 16
+
+// newTestCache returns an opened cache of slots pieces, kept in the
+// file at path or in memory when path is empty
+func newTestCache(t *testing.T, path string, slots int) *pieceCache {
+	c := &pieceCache{capacity: int64(slots) * testPieceLength, path: path, playhead: -1}
+	if _, err := c.OpenTorrent(&metainfo.Info{PieceLength: testPieceLength}, metainfo.Hash{}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestCacheFile returns a path for a cache file, in a
+// temporary directory that cleanup removes
+func newTestCacheFile(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cache", "piece"), func() { os.RemoveAll(dir) }
+}
+
+// pieceData is the content of piece i
+func pieceData(i int) []byte {
+	return bytes.Repeat([]byte{byte('a' + i)}, testPieceLength)
+}
+
+func writePieces(t *testing.T, c *pieceCache, pieces ...int) {
+	t.Helper()
+	for _, i := range pieces {
+		if n, err := c.writeAt(i, pieceData(i), 0); n != testPieceLength || err != nil {
+			t.Fatalf("write of piece %d: %d, %v", i, n, err)
+		}
+	}
+}
+
+func expectCached(t *testing.T, c *pieceCache, pieces ...int) {
+	t.Helper()
+	for _, i := range pieces {
+		b := make([]byte, testPieceLength)
+		if n, err := c.readAt(i, b, 0); n != testPieceLength || err != nil {
+			t.Errorf("read of piece %d: %d, %v", i, n, err)
+		} else if !bytes.Equal(b, pieceData(i)) {
+			t.Errorf("piece %d read as %q", i, b)
+		}
+	}
+}
+
+func expectEvicted(t *testing.T, c *pieceCache, pieces ...int) {
+	t.Helper()
+	for _, i := range pieces {
+		if _, err := c.readAt(i, make([]byte, 1), 0); err != io.ErrUnexpectedEOF {
+			t.Errorf("piece %d still cached: %v", i, err)
+		}
+		if c.complete(i) {
+			t.Errorf("piece %d still complete", i)
+		}
+	}
+}
+
+// testCacheReadWrite writes and reads back pieces at offsets
+func testCacheReadWrite(t *testing.T, c *pieceCache) {
+	expectEvicted(t, c, 3)
+	writePieces(t, c, 3)
+	expectCached(t, c, 3)
+
+	//a piece is written in blocks
+	half := testPieceLength / 2
+	if _, err := c.writeAt(5, pieceData(5)[:half], 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.writeAt(5, pieceData(5)[half:], int64(half)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, half)
+	if n, err := c.readAt(5, b, int64(half)); n != half || err != nil || !bytes.Equal(b, pieceData(5)[half:]) {
+		t.Errorf("read at %d: %q, %d, %v", half, b, n, err)
+	}
+	expectCached(t, c, 3, 5)
+
+	c.setComplete(5, true)
+	if !c.complete(5) || c.complete(3) {
+		t.Error("unexpected completion")
+	}
+}
+
+// testCacheEvict fills c and checks the order pieces are evicted in
+func testCacheEvict(t *testing.T, c *pieceCache) {
+	writePieces(t, c, 0, 1, 2, 3, 4, 5, 6, 7)
+	for i := 0; i < 8; i++ {
+		c.setComplete(i, true)
+	}
+	expectCached(t, c, 0)
+
+	//nobody reads, the least recently used piece goes
+	writePieces(t, c, 8)
+	expectEvicted(t, c, 1)
+	expectCached(t, c, 0, 8)
+
+	//pieces behind the playhead go first, even though used later
+	c.setPlayhead(5)
+	expectCached(t, c, 2, 3, 4, 6, 7)
+	writePieces(t, c, 9)
+	expectEvicted(t, c, 0)
+	writePieces(t, c, 10)
+	expectEvicted(t, c, 2)
+	expectCached(t, c, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	//the piece a slot is wanted for is never evicted
+	c.mut.Lock()
+	if !c.evict(3) {
+		t.Error("nothing evicted")
+	}
+	if _, ok := c.pieces[3]; !ok {
+		t.Error("piece kept evicted")
+	}
+	c.mut.Unlock()
+}
+
+func TestCacheMemory(t *testing.T) {
+	testCacheReadWrite(t, newTestCache(t, "", minCachePieces))
+	testCacheEvict(t, newTestCache(t, "", minCachePieces))
+
+	//a piece is no longer than the piece length
+	c := newTestCache(t, "", minCachePieces)
+	if _, err := c.writeAt(0, pieceData(0), 1); err != io.ErrShortWrite {
+		t.Errorf("write past the piece: %v", err)
+	}
+	writePieces(t, c, 0)
+	if n, err := c.readAt(0, make([]byte, testPieceLength), 1); n != testPieceLength-1 || err != io.EOF {
+		t.Errorf("read past the piece: %d, %v", n, err)
+	}
+	if err := c.discard(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvicted(t, c, 0)
+}
+
+func TestCacheFile(t *testing.T) {
+	path, cleanup := newTestCacheFile(t)
+	defer cleanup()
+	testCacheReadWrite(t, newTestCache(t, path, minCachePieces))
+	testCacheEvict(t, newTestCache(t, path, minCachePieces))
+
+	c := newTestCache(t, path, minCachePieces)
+	writePieces(t, c, 0, 1)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cache file left behind: %v", err)
+	}
+	expectEvicted(t, c, 0, 1)
+}
+
+func TestCacheMinPieces(t *testing.T) {
+	//no room for a single piece, still room for a few
+	c := newTestCache(t, "", 0)
+	if len(c.free) != minCachePieces {
+		t.Fatalf("expected %d slots, got %d", minCachePieces, len(c.free))
+	}
+	writePieces(t, c, 0, 1, 2, 3, 4, 5, 6, 7)
+	expectCached(t, c, 0, 1, 2, 3, 4, 5, 6, 7)
+
+	c = newTestCache(t, "", 2*minCachePieces)
+	if len(c.free) != 2*minCachePieces {
+		t.Errorf("expected %d slots, got %d", 2*minCachePieces, len(c.free))
+	}
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Category groups torrents, torrents of a category keep their data
+// in its save path and fall back to its download limit instead of the global one
+type Category struct {
+	Name string
+	//empty keeps the data where torrents without a category keep it
+	SavePath      string
+	DownloadLimit int64
+}
+
+func (e *Engine) categoriesPath() string {
+	return filepath.Join(e.cacheDir, "categories.json")
+}
+
+// Categories returns every category, by name
+func (e *Engine) Categories() []Category {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	categories := make([]Category, 0, len(e.categories))
+	for _, c := range e.categories {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Name < categories[j].Name
+	})
+	return categories
+}
+
+// SetCategory creates a category or changes an existing one, a
+// relative save path is relative to the download directory. Torrents
+// already in the category keep their data where it is.
+func (e *Engine) SetCategory(c Category) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return fmt.Errorf("missing category name")
+	}
+	if c.DownloadLimit < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if c.SavePath != "" {
+		if !filepath.IsAbs(c.SavePath) {
+			c.SavePath = filepath.Join(e.config.DownloadDirectory, c.SavePath)
+		}
+		c.SavePath = filepath.Clean(c.SavePath)
+		if err := os.MkdirAll(c.SavePath, 0755); err != nil {
+			return fmt.Errorf("invalid save path: %v", err)
+		}
+	}
+	e.categories[c.Name] = c
+	for _, t := range e.ts {
+		if t.Category == c.Name {
+			e.updateLimits(t)
+		}
+	}
+	return e.saveCategories()
+}
+
+// RemoveCategory removes a category, its torrents are
+// left without one
+func (e *Engine) RemoveCategory(name string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if _, ok := e.categories[name]; !ok {
+		return fmt.Errorf("missing category %s", name)
+	}
+	delete(e.categories, name)
+	for _, t := range e.ts {
+		if t.Category == name {
+			t.Category = ""
+			e.updateLimits(t)
+			if err := e.saveState(t); err != nil {
+				e.fail(t.InfoHash, "failed to save torrent", err)
+			}
+		}
+	}
+	return e.saveCategories()
+}
+
+// SetTorrentCategory puts the torrent into a category, an empty
+// name removes it from its category. The data is not moved.
+func (e *Engine) SetTorrentCategory(infohash, category string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if _, ok := e.categories[category]; category != "" && !ok {
+		return fmt.Errorf("missing category %s", category)
+	}
+	t.Category = category
+	e.updateLimits(t)
+	return e.saveState(t)
+}
+
+// SetTorrentTags replaces the tags of the torrent
+func (e *Engine) SetTorrentTags(infohash string, tags []string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Tags = normalizeTags(tags)
+	return e.saveState(t)
+}
+
+// normalizeTags trims tags and drops empty and repeated ones
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// torrentLimit is the download limit of t, falling back
+// to that of its category, e.mut must be held
+func (e *Engine) torrentLimit(t *Torrent) int64 {
+	if c, ok := e.categories[t.Category]; ok && t.DownloadLimit == 0 {
+		return c.DownloadLimit
+	}
+	return t.DownloadLimit
+}
+
+// saveCategories writes every category into the
+// session directory, e.mut must be held
+func (e *Engine) saveCategories() error {
+	if e.cacheDir == "" {
+		return nil
+	}
+	categories := make([]Category, 0, len(e.categories))
+	for _, c := range e.categories {
+		categories = append(categories, c)
+	}
+	b, err := json.MarshalIndent(categories, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(e.categoriesPath(), b)
+}
+
+// loadCategories reads the categories saved in the session
+// directory, they must be known before torrents get restored
+func (e *Engine) loadCategories() error {
+	b, err := ioutil.ReadFile(e.categoriesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var categories []Category
+	if err := json.Unmarshal(b, &categories); err != nil {
+		return err
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	for _, c := range categories {
+		e.categories[c.Name] = c
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package engine
 
+import "time"
+
 type Config struct {
 	AutoStart         bool
 	DisableEncryption bool
@@ -7,4 +9,51 @@ type Config struct {
 	EnableUpload      bool
 	EnableSeeding     bool
 	IncomingPort      int
+	//host to listen on for peers, empty listens on every interface
+	ListenAddress    string
+	SessionDirectory string
+	//new torrents download into IncompleteDirectory, when set, and are
+	//moved into CompletedDirectory, when set, once they are done
+	IncompleteDirectory string
+	CompletedDirectory  string
+	//directory storage may be moved into, defaults to the download directory
+	StorageRoot string
+	//rate limits in bytes per second, 0 is unlimited
+	DownloadRate int64
+	UploadRate   int64
+	//named rate limits switched between by a weekly schedule, outside
+	//of every window of the schedule DownloadRate and UploadRate apply
+	SpeedProfiles []SpeedProfile
+	SpeedSchedule []ScheduleEntry
+	//rate limits applying instead of the schedule while AltSpeed is on
+	AltDownloadRate int64
+	AltUploadRate   int64
+	AltSpeed        bool
+	//profile whose limits apply, set by the engine
+	ActiveProfile string
+	//downloads are held back while less bytes are free, 0 disables the guard
+	MinFreeSpace int64
+	//bytes every torrent may add up to, 0 is unlimited. Torrents beyond it
+	//are refused, or paused once their size is known, and downloads are
+	//held back while it is exceeded.
+	DownloadQuota int64
+	//torrents that don't fit into the free space are refused, or paused
+	//once their size is known, instead of only being warned about
+	RefuseLowSpace bool
+	//how torrent data is written, StorageFile (default) or StorageMMap
+	Storage string
+	//database in the session directory keeping which pieces are complete,
+	//CompletionBolt or CompletionSqlite, empty keeps one in every data directory
+	PieceCompletion string
+	//bytes of pieces an ephemeral torrent caches, 0 is 256 MiB
+	StreamCacheSize int64
+	//the cache of an ephemeral torrent is kept in a single file in
+	//the session directory instead of memory
+	StreamCacheFile bool
+	//seeding goals after which completed torrents are paused, 0 disables a goal
+	SeedRatio float32
+	SeedTime  time.Duration
+	//number of torrents downloading and seeding at the same time, 0 is unlimited
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
 }
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CreateOptions describes a torrent to create from local files
+type CreateOptions struct {
+	//file or directory, relative to the download directory
+	Path string
+	//piece length in bytes, a power of two, 0 picks one from the size
+	PieceLength int64
+	//every tracker gets a tier of its own
+	Trackers []string
+	WebSeeds []string
+	Private  bool
+	Comment  string
+}
+
+// CreatedTorrent is a torrent the engine created and seeds
+type CreatedTorrent struct {
+	InfoHash string
+	Magnet   string
+}
+
+const (
+	minPieceLength = 16 << 10
+	maxPieceLength = 16 << 20
+	//pieces a created torrent aims for when no piece length is given
+	targetPieces = 1500
+)
+
+// CreateTorrent hashes the file or directory at o.Path and starts
+// seeding it right away, in place. It is refused while uploading or
+// seeding is disabled, the torrent would never be shared.
+func (e *Engine) CreateTorrent(o CreateOptions) (*CreatedTorrent, error) {
+	c := e.Config()
+	if !c.EnableUpload || !c.EnableSeeding {
+		return nil, fmt.Errorf("uploading and seeding must be enabled to share a created torrent")
+	}
+	root, err := resolvePath(c.DownloadDirectory, o.Path)
+	if err != nil {
+		return nil, err
+	}
+	l := o.PieceLength
+	if l != 0 && (l < minPieceLength || l > maxPieceLength || l&(l-1) != 0) {
+		return nil, fmt.Errorf("invalid piece length (%d)", l)
+	}
+	for _, u := range o.Trackers {
+		if err := validTrackerURL(u); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range o.WebSeeds {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("invalid web seed (%s)", u)
+		}
+	}
+	size, err := pathSize(root)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("nothing to share in %s", o.Path)
+	}
+	if l == 0 {
+		l = pieceLength(size)
+	}
+
+	info := metainfo.Info{PieceLength: l}
+	if o.Private {
+		private := true
+		info.Private = &private
+	}
+	if err := info.BuildFromFilePath(root); err != nil {
+		return nil, err
+	}
+	mi := &metainfo.MetaInfo{
+		Comment:      o.Comment,
+		CreatedBy:    "pooflix",
+		CreationDate: time.Now().Unix(),
+		UrlList:      o.WebSeeds,
+	}
+	for _, u := range o.Trackers {
+		mi.AnnounceList = append(mi.AnnounceList, []string{u})
+	}
+	if len(o.Trackers) > 0 {
+		mi.Announce = o.Trackers[0]
+	}
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		return nil, err
+	}
+	ih := mi.HashInfoBytes()
+	//anacrolix keeps neither comment, creator nor web seeds, the metainfo
+	//is written before the torrent is added so that saveState keeps it
+	e.mut.Lock()
+	p := e.metainfoPath(ih.HexString())
+	e.mut.Unlock()
+	if err := writeMetainfo(p, mi); err != nil {
+		return nil, err
+	}
+
+	//the data stays where it is, which is not the download directory
+	//for nested paths, even once it is found complete, see moveCompleted
+	s := torrentState{Started: true, AddedAt: time.Now(), Created: true}
+	if base, _ := filepath.Abs(c.DownloadDirectory); filepath.Dir(root) != base {
+		s.DataDirectory = filepath.Dir(root)
+	}
+	client, err := e.torrentClient()
+	if err != nil {
+		return nil, err
+	}
+	tt, err := e.addTorrent(client, mi, s)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.newTorrent(tt, s); err != nil {
+		return nil, err
+	}
+	return &CreatedTorrent{
+		InfoHash: ih.HexString(),
+		Magnet:   mi.Magnet(info.Name, ih).String(),
+	}, nil
+}
+
+// Metainfo returns the .torrent of a torrent whose info is known,
+// as saved in the session directory when it is there
+func (e *Engine) Metainfo(infohash string) ([]byte, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	if t.t == nil || t.t.Info() == nil {
+		return nil, fmt.Errorf("metadata of %s not yet known", t.InfoHash)
+	}
+	if e.cacheDir != "" {
+		if b, err := ioutil.ReadFile(e.metainfoPath(t.InfoHash)); err == nil {
+			return b, nil
+		}
+	}
+	mi := t.t.Metainfo()
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pieceLength doubles the piece length until a torrent
+// of the given size has about targetPieces pieces
+func pieceLength(size int64) int64 {
+	l := int64(256 << 10)
+	for l < maxPieceLength && size/l > targetPieces {
+		l *= 2
+	}
+	return l
+}
+
+// pathSize is the size of the file, or of all files
+// in the directory, at path
+func pathSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/labstack/gommon/log"
+	"path/filepath"
+	"time"
+)
+
+// diskCheckInterval is how often the free space is looked at
+const diskCheckInterval = 10 * time.Second
+
+// DiskSpace is the state of the disk the torrents download to
+type DiskSpace struct {
+	//bytes free in the directory new torrents download to
+	Free int64
+	//bytes the torrents add up to once done, but those paused
+	//for not fitting into the quota
+	Used  int64
+	Quota int64
+	//downloads are held back until Free rises above MinFree again
+	MinFree int64
+	Low     bool
+	//downloads are held back until Used drops to Quota again
+	QuotaExceeded bool
+}
+
+// DiskSpace returns how much space is left for downloads
+func (e *Engine) DiskSpace() (DiskSpace, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	free, err := freeSpace(e.downloadDirectory())
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	return DiskSpace{
+		Free:          free,
+		Used:          e.usedSpace(""),
+		Quota:         e.config.DownloadQuota,
+		MinFree:       e.config.MinFreeSpace,
+		Low:           e.diskLow,
+		QuotaExceeded: e.quotaExceeded,
+	}, nil
+}
+
+// downloadDirectory is where new torrents download to, e.mut must be held
+func (e *Engine) downloadDirectory() string {
+	if e.config.IncompleteDirectory != "" {
+		return e.config.IncompleteDirectory
+	}
+	return e.config.DownloadDirectory
+}
+
+// usedSpace adds up the sizes of every torrent but except, those
+// paused for not fitting into the quota don't count. e.mut must be held.
+func (e *Engine) usedSpace(except string) int64 {
+	var used int64
+	for ih, t := range e.ts {
+		if ih != except && !t.Ephemeral && !t.overQuota {
+			used += t.Size
+		}
+	}
+	return used
+}
+
+// checkQuota tells whether a torrent of the given size
+// fits into the quota, e.mut must be held
+func (e *Engine) checkQuota(infohash string, size int64) error {
+	quota := e.config.DownloadQuota
+	if quota <= 0 {
+		return nil
+	}
+	if used := e.usedSpace(infohash); used+size > quota {
+		return fmt.Errorf("download quota of %d bytes exceeded, %d bytes used", quota, used)
+	}
+	return nil
+}
+
+// checkFree tells whether a torrent of the given size and name fits
+// into dir, data of it already in dir counts as downloaded.
+// e.mut must be held.
+func (e *Engine) checkFree(dir, name string, size int64) error {
+	if dir == "" {
+		dir = e.config.DownloadDirectory
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Warnf("Engine: failed to get free space of %s: %v", dir, err)
+		return nil
+	}
+	needed := size
+	if existing, err := pathSize(filepath.Join(dir, name)); err == nil {
+		needed -= existing
+	}
+	if needed > free-e.config.MinFreeSpace {
+		return fmt.Errorf("%d bytes needed, %d bytes free", needed, free)
+	}
+	return nil
+}
+
+// checkSpec checks the space for a torrent added from spec, torrents
+// beyond the quota are refused, those that don't fit into the free
+// space only when configured so
+func (e *Engine) checkSpec(spec *torrent.TorrentSpec, s torrentState) error {
+	if spec.InfoBytes == nil || s.Ephemeral {
+		//magnet, checked once its info is known
+		return nil
+	}
+	var info metainfo.Info
+	if err := bencode.Unmarshal(spec.InfoBytes, &info); err != nil {
+		return err
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	ih := spec.InfoHash.HexString()
+	if err := e.checkQuota(ih, info.TotalLength()); err != nil {
+		return err
+	}
+	err := e.checkFree(s.DataDirectory, info.Name, info.TotalLength())
+	if err != nil && !e.config.RefuseLowSpace {
+		e.fail(ih, "not enough disk space", err)
+		return nil
+	}
+	return err
+}
+
+// checkMetadata checks the space for a magnet once its info is known,
+// a torrent beyond the quota is paused, one that doesn't fit into the
+// free space only when configured so. e.mut must be held.
+func (e *Engine) checkMetadata(t *Torrent) {
+	if t.Ephemeral {
+		return
+	}
+	pause := false
+	if err := e.checkQuota(t.InfoHash, t.Size); err != nil {
+		e.fail(t.InfoHash, "download quota exceeded", err)
+		t.overQuota = true
+		pause = true
+	} else if err := e.checkFree(t.Directory, t.Name, t.Size); err != nil {
+		e.fail(t.InfoHash, "not enough disk space", err)
+		pause = e.config.RefuseLowSpace
+	}
+	if pause && !t.Paused {
+		e.pauseTorrent(t)
+	}
+}
+
+// fitQuota tells whether t may go on, one paused for not fitting
+// into the quota only once it does. e.mut must be held.
+func (e *Engine) fitQuota(t *Torrent) error {
+	if !t.overQuota {
+		return nil
+	}
+	if err := e.checkQuota(t.InfoHash, t.Size); err != nil {
+		return err
+	}
+	t.overQuota = false
+	return nil
+}
+
+// checkDisk holds back every download while free space is below the
+// configured minimum or the torrents add up to more than the quota,
+// and lets them go on once neither is the case. e.mut must be held.
+func (e *Engine) checkDisk(now time.Time) {
+	if now.Sub(e.diskCheckedAt) < diskCheckInterval {
+		return
+	}
+	e.diskCheckedAt = now
+	low := false
+	if e.config.MinFreeSpace > 0 {
+		free, err := freeSpace(e.downloadDirectory())
+		if err != nil {
+			log.Warnf("Engine: failed to get free space: %v", err)
+			low = e.diskLow
+		} else {
+			low = free < e.config.MinFreeSpace
+		}
+	}
+	exceeded := e.config.DownloadQuota > 0 && e.usedSpace("") > e.config.DownloadQuota
+	if low == e.diskLow && exceeded == e.quotaExceeded {
+		return
+	}
+	if low != e.diskLow {
+		if low {
+			log.Warnf("Engine: Disk space low, downloads held back.")
+		} else {
+			log.Infof("Engine: Disk space available again, downloads go on.")
+		}
+	}
+	if exceeded != e.quotaExceeded {
+		if exceeded {
+			log.Warnf("Engine: Download quota exceeded, downloads held back.")
+		} else {
+			log.Infof("Engine: Download quota met again, downloads go on.")
+		}
+	}
+	e.diskLow, e.quotaExceeded = low, exceeded
+	e.manageQueue()
+	e.publish(Event{Type: EventDiskSpace})
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package engine
+
+import "syscall"
+
+// freeSpace is how many bytes may still be written into dir
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
@@ -5,122 +5,516 @@ import (
 	"fmt"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
 	"github.com/labstack/gommon/log"
+	"golang.org/x/time/rate"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
-//the Engine Cloud Torrent engine, backed by anacrolix/torrent
+// the Engine Cloud Torrent engine, backed by anacrolix/torrent,
+// it is safe for concurrent use: mut guards the client, the config
+// and every torrent, callers only ever get snapshots of them
 type Engine struct {
 	mut      sync.Mutex
 	cacheDir string
+	maxConns int
 	client   *torrent.Client
 	config   Config
 	ts       map[string]*Torrent
+	//serializes Configure, which can't hold mut while the client restarts
+	configureMut sync.Mutex
+	//infohashes in queue order
+	queue  []string
+	bus    bus
+	peerID [20]byte
+	//closed once the announcer of the torrent finished, see announcer
+	announcers map[string]chan struct{}
+	//shared by every client, so limits survive a reconfigure
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
+	//global limits of the active speed profile
+	speedDownload int64
+	speedUpload   int64
+	//free space is below MinFreeSpace or the torrents add
+	//up to more than DownloadQuota, see checkDisk
+	diskLow       bool
+	quotaExceeded bool
+	diskCheckedAt time.Time
+	//progress of the torrents was last saved, see saveProgress
+	savedAt time.Time
+	//per torrent download limiters, they have their own lock as
+	//storage writes look them up from within anacrolix
+	limiterMut sync.RWMutex
+	limiters   map[string]*rate.Limiter
+	//storage of every directory data is kept in, see openStorage
+	storageMut  sync.Mutex
+	storages    map[string]storage.ClientImpl
+	storageKind string
+	completion  storage.PieceCompletion
+	//storage of every ephemeral torrent
+	caches     map[string]*pieceCache
+	categories map[string]Category
 }
 
 func New() *Engine {
-	return &Engine{ts: map[string]*Torrent{}}
+	e := &Engine{
+		ts:              map[string]*Torrent{},
+		limiters:        map[string]*rate.Limiter{},
+		storages:        map[string]storage.ClientImpl{},
+		caches:          map[string]*pieceCache{},
+		announcers:      map[string]chan struct{}{},
+		categories:      map[string]Category{},
+		downloadLimiter: newLimiter(0),
+		uploadLimiter:   newLimiter(0),
+		peerID:          newPeerID(),
+	}
+	go e.run()
+	return e
+}
+
+// run keeps torrents up to date and applies the speed
+// schedule, seeding goals and queue, anacrolix has none of them
+func (e *Engine) run() {
+	for now := range time.Tick(1 * time.Second) {
+		e.mut.Lock()
+		if e.client != nil {
+			e.applySpeed(now)
+			e.checkDisk(now)
+			//only newTorrent registers torrents, those anacrolix has
+			//that are not registered yet are still being added
+			for _, t := range e.ts {
+				t.Update(t.t)
+				e.checkSeeding(t, now)
+				e.stream(t)
+			}
+			e.manageQueue()
+			e.saveProgress(now)
+		}
+		e.mut.Unlock()
+	}
 }
 
 func (e *Engine) Config() Config {
+	e.mut.Lock()
+	defer e.mut.Unlock()
 	return e.config
 }
 
+// Configure (re)creates the anacrolix client, torrents of
+// a previous client are carried over with their state
 func (e *Engine) Configure(c Config) error {
-	//recieve config
-	if e.client != nil {
+	if c.IncomingPort <= 0 || c.IncomingPort > 65535 {
+		return fmt.Errorf("invalid incoming port (%d)", c.IncomingPort)
+	}
+	if err := validateSchedule(c); err != nil {
+		return err
+	}
+	if c.MinFreeSpace < 0 || c.DownloadQuota < 0 {
+		return fmt.Errorf("invalid disk space limit")
+	}
+	if err := validateStorage(c); err != nil {
+		return err
+	}
+	if c.SessionDirectory == "" {
+		c.SessionDirectory = filepath.Join(c.DownloadDirectory, ".session")
+	}
+	if err := os.MkdirAll(c.SessionDirectory, 0755); err != nil {
+		return fmt.Errorf("invalid session directory: %v", err)
+	}
+	for _, dir := range []string{c.IncompleteDirectory, c.CompletedDirectory} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("invalid directory: %v", err)
+		}
+	}
+
+	e.configureMut.Lock()
+	defer e.configureMut.Unlock()
+
+	e.mut.Lock()
+	first := e.client == nil
+	prev := e.config
+	running := e.snapshot()
+	if !first {
 		e.client.Close()
+		e.client = nil
+		e.closeStorages()
+	}
+	e.mut.Unlock()
+	if !first {
+		//give the listeners time to release the port
 		time.Sleep(1 * time.Second)
 	}
-	if c.IncomingPort <= 0 {
-		return fmt.Errorf("invalid incoming port (%d)", c.IncomingPort)
+
+	client, tc, err := e.newClient(c)
+	if err != nil {
+		if !first {
+			//bring the previous client back so no torrent is lost
+			if client, tc, perr := e.newClient(prev); perr == nil {
+				e.attach(client, tc, prev)
+				e.readd(running)
+			} else {
+				log.Errorf("Engine: failed to restore previous client: %v", perr)
+			}
+		}
+		return err
 	}
-	/*tc := torrent.ClientConfig{
-		DhtStartingNodes: dht.GlobalBootstrapAddrs,
-		DataDir:          c.DownloadDirectory,
-		ListenHost:       func(string) string { return "" },
-		ListenPort:       c.IncomingPort,
-		NoUpload:         !c.EnableUpload,
-		Seed:             c.EnableSeeding,
-	}*/
-	tc := *torrent.NewDefaultClientConfig()
+	e.attach(client, tc, c)
+	if first {
+		if err := e.loadCategories(); err != nil {
+			log.Warnf("Engine: failed to load categories: %v", err)
+		}
+		if err := e.loadSession(); err != nil {
+			return fmt.Errorf("failed to load session: %v", err)
+		}
+	} else {
+		e.readd(running)
+	}
+	return nil
+}
+
+func (e *Engine) newClient(c Config) (*torrent.Client, *torrent.ClientConfig, error) {
+	tc := torrent.NewDefaultClientConfig()
 	tc.DataDir = c.DownloadDirectory
+	tc.ListenHost = func(string) string { return c.ListenAddress }
+	if ip := net.ParseIP(c.ListenAddress); ip != nil {
+		//an address only listens on the networks of its family
+		tc.DisableIPv6 = ip.To4() != nil
+		tc.DisableIPv4 = ip.To4() == nil
+	}
+	tc.ListenPort = c.IncomingPort
 	tc.DisableEncryption = c.DisableEncryption
+	tc.NoUpload = !c.EnableUpload
+	tc.Seed = c.EnableSeeding
+	//see announcer, trackers must see the peer id peers do
+	tc.DisableTrackers = true
+	tc.PeerID = string(e.peerID[:])
+	if err := e.openStorage(c); err != nil {
+		return nil, nil, err
+	}
+	tc.DefaultStorage = e.newStorage(c.DownloadDirectory)
+	//see applySpeed
+	tc.DownloadRateLimiter = e.downloadLimiter
+	tc.UploadRateLimiter = e.uploadLimiter
 
-	client, err := torrent.NewClient(&tc)
+	client, err := torrent.NewClient(tc)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return client, tc, nil
+}
+
+func (e *Engine) attach(client *torrent.Client, tc *torrent.ClientConfig, c Config) {
 	e.mut.Lock()
+	defer e.mut.Unlock()
 	e.config = c
 	e.client = client
-	e.mut.Unlock()
-	//reset
-	e.GetTorrents()
-	return nil
+	e.maxConns = tc.EstablishedConnsPerTorrent
+	e.cacheDir = c.SessionDirectory
+	//torrents of a closed client are dead, they get added again
+	e.ts = map[string]*Torrent{}
+	e.queue = nil
+	e.limiterMut.Lock()
+	e.limiters = map[string]*rate.Limiter{}
+	e.limiterMut.Unlock()
+	//always applied, the profiles may have changed
+	e.config.ActiveProfile = ""
+	e.applySpeed(time.Now())
+	log.Infof("Engine: Listening on %v.", client.ListenAddrs())
 }
 
-func (e *Engine) NewMagnet(magnetURI string) error {
-	tt, err := e.client.AddMagnet(magnetURI)
+// runningTorrent is a torrent carried over to a new client
+type runningTorrent struct {
+	state torrentState
+	mi    *metainfo.MetaInfo
+}
+
+// snapshot captures every torrent in queue order, e.mut must be held
+func (e *Engine) snapshot() []runningTorrent {
+	var running []runningTorrent
+	for _, ih := range e.queue {
+		t, ok := e.ts[ih]
+		if !ok {
+			continue
+		}
+		r := runningTorrent{state: t.state()}
+		if t.t != nil && t.t.Info() != nil {
+			mi := t.t.Metainfo()
+			r.mi = &mi
+		}
+		running = append(running, r)
+	}
+	return running
+}
+
+// readd adds the captured torrents to the current client
+func (e *Engine) readd(running []runningTorrent) {
+	client, err := e.torrentClient()
+	if err != nil {
+		log.Errorf("Engine: failed to carry over torrents: %v", err)
+		return
+	}
+	for _, r := range running {
+		var tt *torrent.Torrent
+		var err error
+		switch {
+		case r.mi != nil:
+			tt, err = e.addTorrent(client, r.mi, r.state)
+		case r.state.Magnet != "":
+			tt, err = e.addMagnet(client, r.state.Magnet, r.state)
+		default:
+			//no metadata yet, the session may still have it
+			err = e.restoreTorrent(r.state)
+			if err != nil {
+				e.fail(r.state.InfoHash, "failed to carry over torrent", err)
+			}
+			continue
+		}
+		if err == nil {
+			err = e.newTorrent(tt, r.state)
+		}
+		if err != nil {
+			e.fail(r.state.InfoHash, "failed to carry over torrent", err)
+		}
+	}
+}
+
+// torrentClient is the current client, torrents are added to it
+// without holding e.mut as anacrolix may block on the network
+func (e *Engine) torrentClient() (*torrent.Client, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.client == nil {
+		return nil, fmt.Errorf("engine not configured")
+	}
+	return e.client, nil
+}
+
+// addSpec adds spec to client, the data of an ephemeral torrent is
+// kept in a cache, that of others in the data directory of s or,
+// when empty, in the download directory
+func (e *Engine) addSpec(client *torrent.Client, spec *torrent.TorrentSpec, s torrentState) (*torrent.Torrent, error) {
+	var cache *pieceCache
+	switch {
+	case s.Ephemeral:
+		cache = e.newCache(spec.InfoHash)
+		spec.Storage = limitedStorage{cache, e.torrentLimiter}
+	case s.DataDirectory != "":
+		spec.Storage = e.newStorage(s.DataDirectory)
+	}
+	tt, added, err := client.AddTorrentSpec(spec)
+	if err == nil && added && cache != nil {
+		e.storageMut.Lock()
+		e.caches[tt.InfoHash().HexString()] = cache
+		e.storageMut.Unlock()
+	}
+	return tt, err
+}
+
+func (e *Engine) addTorrent(client *torrent.Client, mi *metainfo.MetaInfo, s torrentState) (*torrent.Torrent, error) {
+	return e.addSpec(client, torrent.TorrentSpecFromMetaInfo(mi), s)
+}
+
+func (e *Engine) addMagnet(client *torrent.Client, uri string, s torrentState) (*torrent.Torrent, error) {
+	spec, err := torrent.TorrentSpecFromMagnetURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return e.addSpec(client, spec, s)
+}
+
+// AddOptions are applied to a torrent when it gets added
+type AddOptions struct {
+	Category string
+	Tags     []string
+	//added paused, it does not connect to any peer until resumed
+	Paused bool
+	//only streamed, pieces are kept in a bounded cache instead of
+	//the download directory and are gone once the torrent is removed
+	Ephemeral bool
+}
+
+func (e *Engine) NewMagnet(magnetURI string, o AddOptions) error {
+	client, err := e.torrentClient()
 	if err != nil {
 		return err
 	}
-	return e.newTorrent(tt)
+	s, err := e.addState(o)
+	if err != nil {
+		return err
+	}
+	s.Magnet = magnetURI
+	tt, err := e.addMagnet(client, magnetURI, s)
+	if err != nil {
+		return err
+	}
+	return e.newTorrent(tt, s)
 }
 
-func (e *Engine) NewTorrent(spec *torrent.TorrentSpec) error {
-	tt, _, err := e.client.AddTorrentSpec(spec)
+func (e *Engine) NewTorrent(spec *torrent.TorrentSpec, o AddOptions) error {
+	client, err := e.torrentClient()
+	if err != nil {
+		return err
+	}
+	s, err := e.addState(o)
+	if err != nil {
+		return err
+	}
+	if err := e.checkSpec(spec, s); err != nil {
+		return err
+	}
+	tt, err := e.addSpec(client, spec, s)
 	if err != nil {
 		return err
 	}
-	return e.newTorrent(tt)
+	return e.newTorrent(tt, s)
 }
 
-func (e *Engine) newTorrent(tt *torrent.Torrent) error {
-	t := e.upsertTorrent(tt)
-	go func() {
-		<-t.t.GotInfo()
-		// if e.config.AutoStart && !loaded && torrent.Loaded && !torrent.Started {
-		e.StartTorrent(t.InfoHash)
-		// }
-	}()
+// addState is the state a torrent starts out with, it downloads
+// into the incomplete directory or else the save path of its category
+func (e *Engine) addState(o AddOptions) (torrentState, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	s := torrentState{
+		Started:       e.config.AutoStart,
+		Paused:        o.Paused,
+		AddedAt:       time.Now(),
+		DataDirectory: e.config.IncompleteDirectory,
+		Category:      o.Category,
+		Tags:          normalizeTags(o.Tags),
+		Ephemeral:     o.Ephemeral,
+	}
+	if o.Category != "" {
+		c, ok := e.categories[o.Category]
+		if !ok {
+			return s, fmt.Errorf("missing category %s", o.Category)
+		}
+		if s.DataDirectory == "" {
+			s.DataDirectory = c.SavePath
+		}
+	}
+	return s, nil
+}
+
+// newTorrent registers tt with the engine and, once its info
+// is known, starts it according to the given state
+func (e *Engine) newTorrent(tt *torrent.Torrent, s torrentState) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	ih := tt.InfoHash().HexString()
+	if _, ok := e.ts[ih]; ok {
+		return fmt.Errorf("torrent %s already added", ih)
+	}
+	t := &Torrent{InfoHash: ih, announceNow: make(chan struct{}, 1)}
+	t.Update(tt)
+	e.ts[ih] = t
+	t.magnet = s.Magnet
+	t.dataDir = s.DataDirectory
+	t.Directory = s.DataDirectory
+	if t.Directory == "" {
+		t.Directory = e.config.DownloadDirectory
+	}
+	t.AddedAt = s.AddedAt
+	t.Paused = s.Paused
+	t.overQuota = s.OverQuota
+	t.created = s.Created
+	t.Category = s.Category
+	t.Tags = s.Tags
+	t.Ephemeral = s.Ephemeral
+	t.DownloadLimit = s.DownloadLimit
+	e.updateLimits(t)
+	t.SeedRatio = s.SeedRatio
+	t.SeedTime = s.SeedTime
+	t.SeedingTime = s.SeedingTime
+	t.SeedingGoalReached = s.SeedingGoalReached
+	t.uploadedBase = s.Uploaded
+	t.Uploaded = s.Uploaded
+	t.TimeActive = s.TimeActive
+	t.Streaming = s.Streaming
+	t.Started = s.Started
+	if t.Paused {
+		t.setMaxConns(0)
+	}
+	tiers := s.Trackers
+	if tiers == nil {
+		mi := tt.Metainfo()
+		tiers = mi.UpvertedAnnounceList()
+	}
+	t.trackers = newTrackers(tiers)
+	e.queue = append(e.queue, t.InfoHash)
+	e.manageQueue()
+
+	//restored torrents are already in the session
+	if s.InfoHash == "" {
+		if err := e.saveState(t); err != nil {
+			e.fail(t.InfoHash, "failed to save torrent", err)
+		}
+	}
 
-	log.Infof("Engine: Torrent <%s> added, size: %d.", tt.Name(), tt.Length())
+	go e.watch(t, tt, s)
+	done := make(chan struct{})
+	prev := e.announcers[t.InfoHash]
+	e.announcers[t.InfoHash] = done
+	go e.announcer(t, tt, prev, done)
+
+	//the size of a magnet is only known once its info is
+	log.Infof("Engine: Torrent <%s> added, size: %d.", t.Name, t.Size)
+	e.publish(Event{Type: EventAdded, InfoHash: t.InfoHash})
 
 	return nil
 }
 
-//GetTorrents moves torrents out of the anacrolix/torrent
-//and into the local cache
+// restoreFiles sets the file priorities and streaming
+// modes saved with the torrent state
+func (e *Engine) restoreFiles(t *Torrent, s torrentState) {
+	streaming := map[string]bool{}
+	for _, path := range s.StreamingFiles {
+		streaming[path] = true
+	}
+	for _, f := range t.Files {
+		if f == nil {
+			continue
+		}
+		if p, ok := s.Files[f.Path]; ok {
+			f.Priority = p
+			f.Started = p != PrioritySkip
+		}
+		f.Streaming = streaming[f.Path]
+	}
+}
+
+// GetTorrents returns a snapshot of every torrent, as of the
+// last update of the engine loop
 func (e *Engine) GetTorrents() map[string]*Torrent {
 	e.mut.Lock()
 	defer e.mut.Unlock()
 
-	if e.client == nil {
-		return nil
-	}
-	for _, tt := range e.client.Torrents() {
-		e.upsertTorrent(tt)
+	ts := make(map[string]*Torrent, len(e.ts))
+	for ih, t := range e.ts {
+		ts[ih] = t.snapshot()
 	}
-	return e.ts
+	return ts
 }
 
-func (e *Engine) upsertTorrent(tt *torrent.Torrent) *Torrent {
-	ih := tt.InfoHash().HexString()
-	t, ok := e.ts[ih]
-	if !ok {
-		t = &Torrent{InfoHash: ih}
-		e.ts[ih] = t
-	}
-	//update torrent fields using underlying torrent
+// GetTorrent returns a snapshot of a single torrent
+func (e *Engine) GetTorrent(infohash string) (*Torrent, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
 
-	t.Update(tt)
-	return t
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	return t.snapshot(), nil
 }
 
+// getTorrent looks up the live torrent, e.mut must be held
 func (e *Engine) getTorrent(infohash string) (*Torrent, error) {
 	ih, err := str2ih(infohash)
 	if err != nil {
@@ -133,42 +527,31 @@ func (e *Engine) getTorrent(infohash string) (*Torrent, error) {
 	return t, nil
 }
 
-func (e *Engine) getOpenTorrent(infohash string) (*Torrent, error) {
-	t, err := e.getTorrent(infohash)
-	if err != nil {
-		return nil, err
-	}
-	// if t.t == nil {
-	// 	newt, err := e.client.AddTorrentFromFile(filepath.Join(e.cacheDir, infohash+".torrent"))
-	// 	if err != nil {
-	// 		return t, fmt.Errorf("Failed to open torrent %s", err)
-	// 	}
-	// 	t.t = &newt
-	// }
-	return t, nil
-}
-
+// StartTorrent downloads every file of the torrent that
+// is not skipped, as soon as the queue has a slot for it
 func (e *Engine) StartTorrent(infohash string) error {
-	t, err := e.getOpenTorrent(infohash)
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
 	if err != nil {
 		return err
 	}
 	if t.Started {
 		return fmt.Errorf("already started")
 	}
-	t.Started = true
-	for _, f := range t.Files {
-		if f != nil {
-			f.Started = true
-		}
-	}
-	if t.t.Info() != nil {
-		t.t.DownloadAll()
+	if err := e.fitQuota(t); err != nil {
+		return err
 	}
-	return nil
+	t.Started = true
+	t.Paused = false
+	e.manageQueue()
+	e.publish(Event{Type: EventStarted, InfoHash: t.InfoHash})
+	return e.saveState(t)
 }
 
 func (e *Engine) StopTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
 	t, err := e.getTorrent(infohash)
 	if err != nil {
 		return err
@@ -176,57 +559,171 @@ func (e *Engine) StopTorrent(infohash string) error {
 	if !t.Started {
 		return fmt.Errorf("already stopped")
 	}
-	//there is no stop - kill underlying torrent
-	t.t.Drop()
 	t.Started = false
+	e.cancelDownload(t)
+	e.manageQueue()
+	e.publish(Event{Type: EventStopped, InfoHash: t.InfoHash})
+	return e.saveState(t)
+}
+
+// PauseTorrent disconnects all peers and cancels pending pieces,
+// the torrent stays loaded so ResumeTorrent can pick it up again
+func (e *Engine) PauseTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if t.Paused {
+		return fmt.Errorf("already paused")
+	}
+	e.pauseTorrent(t)
+	return e.saveState(t)
+}
+
+func (e *Engine) pauseTorrent(t *Torrent) {
+	t.Paused = true
+	e.cancelDownload(t)
+	t.setMaxConns(0)
+	t.reannounce()
+	e.manageQueue()
+	e.publish(Event{Type: EventPaused, InfoHash: t.InfoHash})
+}
+
+// ResumeTorrent reconnects to peers and continues downloading
+// the files that were selected when the torrent got paused
+func (e *Engine) ResumeTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if !t.Paused {
+		return fmt.Errorf("not paused")
+	}
+	if err := e.fitQuota(t); err != nil {
+		return err
+	}
+	t.Paused = false
+	t.setMaxConns(e.maxConns)
+	t.reannounce()
+	e.manageQueue()
+	e.publish(Event{Type: EventStarted, InfoHash: t.InfoHash})
+	return e.saveState(t)
+}
+
+// download requests the pieces of every file according to its
+// priority, ephemeral torrents only download what gets read
+func (e *Engine) download(t *Torrent) {
+	if t.t.Info() == nil || t.Ephemeral {
+		return
+	}
 	for _, f := range t.Files {
 		if f != nil {
-			f.Started = false
+			f.Priority.apply(f.f)
 		}
 	}
-	return nil
 }
 
-func (e *Engine) DeleteTorrent(infohash string) error {
+// cancelDownload stops requesting pieces without touching
+// the file selection
+func (e *Engine) cancelDownload(t *Torrent) {
+	if t.t.Info() == nil {
+		return
+	}
+	for _, f := range t.Files {
+		if f != nil {
+			f.f.SetPriority(torrent.PiecePriorityNone)
+		}
+	}
+	t.t.CancelPieces(0, t.t.NumPieces())
+	e.stopStreaming(t)
+}
+
+// DeleteTorrent removes the torrent, with deleteData its files and
+// the directories they leave empty are removed as well
+func (e *Engine) DeleteTorrent(infohash string, deleteData bool) error {
+	e.mut.Lock()
 	t, err := e.getTorrent(infohash)
 	if err != nil {
+		e.mut.Unlock()
 		return err
 	}
-	os.Remove(filepath.Join(e.cacheDir, infohash+".torrent"))
+	//ephemeral data is gone along with the torrent
+	var files []string
+	if deleteData && !t.Ephemeral {
+		for _, f := range t.Files {
+			if f != nil {
+				files = append(files, f.Path)
+			}
+		}
+	}
+	dir, name := t.Directory, t.Name
+	e.removeState(t.InfoHash)
+	if t.t != nil {
+		t.t.Drop()
+	}
 	delete(e.ts, t.InfoHash)
-	ih, _ := str2ih(infohash)
-	if tt, ok := e.client.Torrent(ih); ok {
-		tt.Drop()
+	e.removeCache(t.InfoHash)
+	e.limiterMut.Lock()
+	delete(e.limiters, t.InfoHash)
+	e.limiterMut.Unlock()
+	e.dequeue(t.InfoHash)
+	e.manageQueue()
+	e.mut.Unlock()
+
+	var derr error
+	if len(files) > 0 {
+		log.Infof("Engine: Deleting data of <%s> in %s.", name, dir)
+		derr = removeData(dir, files)
+	}
+	e.publish(Event{Type: EventRemoved, InfoHash: t.InfoHash})
+	if derr != nil {
+		return fmt.Errorf("failed to delete data: %v", derr)
 	}
 	return nil
 }
 
 func (e *Engine) StartFile(infohash, filepath string) error {
-	t, err := e.getOpenTorrent(infohash)
+	return e.SetFilePriority(infohash, filepath, PriorityNormal)
+}
+
+func (e *Engine) StopFile(infohash, filepath string) error {
+	return e.SetFilePriority(infohash, filepath, PrioritySkip)
+}
+
+// SetFilePriority changes the priority of a single file, it is
+// applied right away when the torrent is downloading and
+// otherwise as soon as it gets started. Ephemeral torrents
+// only ever download what gets read, see download.
+func (e *Engine) SetFilePriority(infohash, filepath string, p Priority) error {
+	if _, err := ParsePriority(string(p)); err != nil {
+		return err
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
 	if err != nil {
 		return err
 	}
 	var f *File
 	for _, file := range t.Files {
-		if file.Path == filepath {
+		if file != nil && file.Path == filepath {
 			f = file
 			break
 		}
 	}
 	if f == nil {
-		return fmt.Errorf(",issing file %s", filepath)
+		return fmt.Errorf("missing file %s", filepath)
 	}
-	if f.Started {
-		return fmt.Errorf("already started")
+	f.Priority = p
+	f.Started = p != PrioritySkip
+	if t.active && !t.Ephemeral {
+		p.apply(f.f)
 	}
-	t.Started = true
-	f.Started = true
-	f.f.SetPriority(f.f.Priority()) //PrioritizeRegion(0, f.Size)
-	return nil
-}
-
-func (e *Engine) StopFile(infohash, filepath string) error {
-	return fmt.Errorf("unsupported")
+	return e.saveState(t)
 }
 
 func str2ih(str string) (metainfo.Hash, error) {
@@ -0,0 +1,545 @@
+package engine
+
+// these tests run a real anacrolix client on localhost, they
+// are meant to be run with the race detector: go test -race ./engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// testConfig downloads into dir, keeping the session in it
+func testConfig(t *testing.T, dir string) Config {
+	return Config{
+		AutoStart:         true,
+		DownloadDirectory: dir,
+		SessionDirectory:  filepath.Join(dir, ".session"),
+		IncomingPort:      freePort(t),
+		ListenAddress:     "127.0.0.1",
+		EnableUpload:      true,
+		EnableSeeding:     true,
+	}
+}
+
+// newTestEngine returns an engine configured to download into
+// a temporary directory, which cleanup removes
+func newTestEngine(t *testing.T) (e *Engine, dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = New()
+	if err := e.Configure(testConfig(t, dir)); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return e, dir, func() { os.RemoveAll(dir) }
+}
+
+// testMetainfo writes a file of size random bytes into dir
+// and returns the metainfo of it
+func testMetainfo(t *testing.T, dir, name string, size int) *metainfo.MetaInfo {
+	b := make([]byte, size)
+	rand.Read(b)
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: minPieceLength}
+	if err := info.BuildFromFilePath(p); err != nil {
+		t.Fatal(err)
+	}
+	mi := &metainfo.MetaInfo{}
+	var err error
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+	return mi
+}
+
+// addAll adds every torrent at once, half of them by magnet and
+// the others by metainfo, errors are sent to errs
+func addAll(e *Engine, mis []*metainfo.MetaInfo, errs chan<- error) {
+	var wg sync.WaitGroup
+	for i, mi := range mis {
+		wg.Add(1)
+		go func(i int, mi *metainfo.MetaInfo) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				err = e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{})
+			} else {
+				ih := mi.HashInfoBytes()
+				err = e.NewMagnet(mi.Magnet(fmt.Sprintf("file%d", i), ih).String(), AddOptions{})
+			}
+			if err != nil {
+				errs <- fmt.Errorf("failed to add torrent %d: %v", i, err)
+			}
+		}(i, mi)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	const n = 8
+	var mis []*metainfo.MetaInfo
+	var hashes []string
+	for i := 0; i < n; i++ {
+		mi := testMetainfo(t, dir, fmt.Sprintf("file%d", i), 100<<10)
+		mis = append(mis, mi)
+		hashes = append(hashes, mi.HashInfoBytes().HexString())
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 2*n)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		addAll(e, mis, errs)
+	}()
+	for _, f := range []func(ih string){
+		func(ih string) { e.StopTorrent(ih) },
+		func(ih string) { e.StartTorrent(ih) },
+		func(ih string) { e.PauseTorrent(ih) },
+		func(ih string) { e.ResumeTorrent(ih) },
+	} {
+		wg.Add(1)
+		go func(f func(ih string)) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f(hashes[rand.Intn(n)])
+			}
+		}(f)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := json.Marshal(e.GetTorrents()); err != nil {
+				errs <- fmt.Errorf("failed to marshal torrents: %v", err)
+				return
+			}
+		}
+	}()
+	//let the engine loop update the torrents a few times
+	time.Sleep(3 * time.Second)
+	for _, ih := range hashes[:n/2] {
+		wg.Add(1)
+		go func(ih string) {
+			defer wg.Done()
+			e.DeleteTorrent(ih, false)
+		}(ih)
+	}
+	time.Sleep(2 * time.Second)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	ts := e.GetTorrents()
+	for _, ih := range hashes[:n/2] {
+		if _, ok := ts[ih]; ok {
+			t.Errorf("deleted torrent %s still listed", ih)
+		}
+	}
+	for _, ih := range hashes[n/2:] {
+		if _, ok := ts[ih]; !ok {
+			t.Errorf("torrent %s missing", ih)
+		}
+	}
+}
+
+// TestConcurrentAdd adds and deletes torrents for a few ticks of
+// the engine loop, which must never get in the way of an add
+func TestConcurrentAdd(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	const n = 16
+	var mis []*metainfo.MetaInfo
+	for i := 0; i < n; i++ {
+		mis = append(mis, testMetainfo(t, dir, fmt.Sprintf("file%d", i), 16<<10))
+	}
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		errs := make(chan error, n)
+		addAll(e, mis, errs)
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		ts := e.GetTorrents()
+		for _, mi := range mis {
+			ih := mi.HashInfoBytes().HexString()
+			if _, ok := ts[ih]; !ok {
+				t.Fatalf("torrent %s missing", ih)
+			}
+			if err := e.DeleteTorrent(ih, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestDeleteRightAway deletes torrents whose info is known from the
+// start before they got watched, they must stay deleted
+func TestDeleteRightAway(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	mi := testMetainfo(t, dir, "data", 16<<10)
+	ih := mi.HashInfoBytes().HexString()
+	for i := 0; i < 20; i++ {
+		if err := e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.DeleteTorrent(ih, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := e.GetTorrent(ih); err == nil {
+		t.Error("deleted torrent listed again")
+	}
+	if _, err := os.Stat(e.statePath(ih)); !os.IsNotExist(err) {
+		t.Errorf("state of deleted torrent saved: %v", err)
+	}
+}
+
+func TestDeleteTorrentData(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	mi := testMetainfo(t, dir, "data", 100<<10)
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ih := mi.HashInfoBytes().HexString()
+	if err := e.DeleteTorrent(ih, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data")); !os.IsNotExist(err) {
+		t.Errorf("data of deleted torrent left behind: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("data of no torrent deleted: %v", err)
+	}
+	if _, err := e.GetTorrent(ih); err == nil {
+		t.Errorf("deleted torrent still listed")
+	}
+}
+
+func TestCreateTorrentMetainfo(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	testMetainfo(t, dir, "shared", 100<<10)
+	created, err := e.CreateTorrent(CreateOptions{
+		Path:     "shared",
+		Trackers: []string{"http://127.0.0.1:1/announce"},
+		WebSeeds: []string{"http://127.0.0.1:1/shared"},
+		Comment:  "comment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Metainfo(created.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := metainfo.Load(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mi.Comment != "comment" || mi.CreatedBy == "" || len(mi.UrlList) != 1 {
+		t.Errorf("metainfo lost comment, creator or web seeds: %+v", mi)
+	}
+}
+
+// TestQuotaPaused checks a torrent paused for not fitting into the
+// quota holds back neither itself nor any other download
+func TestQuotaPaused(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	big := testMetainfo(t, dir, "big", 100<<10)
+	small := testMetainfo(t, dir, "small", 16<<10)
+	//not downloaded yet
+	os.Remove(filepath.Join(dir, "small"))
+	for _, mi := range []*metainfo.MetaInfo{big, small} {
+		if err := e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bigIH, smallIH := big.HashInfoBytes().HexString(), small.HashInfoBytes().HexString()
+
+	e.mut.Lock()
+	e.config.DownloadQuota = 50 << 10
+	//as if the info of a magnet just got known
+	e.checkMetadata(e.ts[bigIH])
+	e.checkDisk(time.Now().Add(2 * diskCheckInterval))
+	paused, exceeded, queued := e.ts[bigIH].Paused, e.quotaExceeded, e.ts[smallIH].Queued
+	e.mut.Unlock()
+	if !paused {
+		t.Fatal("torrent beyond the quota not paused")
+	}
+	if exceeded || queued {
+		t.Fatalf("downloads held back by a paused torrent, quota exceeded: %v", exceeded)
+	}
+	if err := e.ResumeTorrent(bigIH); err == nil {
+		t.Fatal("torrent beyond the quota resumed")
+	}
+
+	e.mut.Lock()
+	e.config.DownloadQuota = 1 << 20
+	e.mut.Unlock()
+	if err := e.ResumeTorrent(bigIH); err != nil {
+		t.Fatalf("torrent fitting into the quota not resumed: %v", err)
+	}
+}
+
+// TestSaveProgress checks the progress towards seeding goals
+// is saved while running and when closed
+func TestSaveProgress(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	mi := testMetainfo(t, dir, "data", 16<<10)
+	if err := e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ih := mi.HashInfoBytes().HexString()
+	expectSaved := func(seedingTime time.Duration) {
+		t.Helper()
+		s, err := readState(e.statePath(ih))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.SeedingTime < seedingTime {
+			t.Fatalf("expected seeding time of at least %s saved, got %s", seedingTime, s.SeedingTime)
+		}
+	}
+
+	e.mut.Lock()
+	e.ts[ih].SeedingTime = 5 * time.Minute
+	e.saveProgress(time.Now().Add(2 * progressSaveInterval))
+	e.mut.Unlock()
+	expectSaved(5 * time.Minute)
+
+	e.mut.Lock()
+	e.ts[ih].SeedingTime = 10 * time.Minute
+	e.mut.Unlock()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectSaved(10 * time.Minute)
+}
+
+// TestEphemeralPriority checks file priorities leave the pieces of
+// ephemeral torrents alone, they are only fetched when read
+func TestEphemeralPriority(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	mi := testMetainfo(t, dir, "data", 100<<10)
+	err := e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{Ephemeral: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ih := mi.HashInfoBytes().HexString()
+	for _, p := range []Priority{PriorityNormal, PriorityHigh, PriorityNow} {
+		if err := e.SetFilePriority(ih, "data", p); err != nil {
+			t.Fatal(err)
+		}
+		e.mut.Lock()
+		tt := e.ts[ih].t
+		e.mut.Unlock()
+		for i := 0; i < tt.NumPieces(); i++ {
+			if s := tt.PieceState(i); s.Priority != torrent.PiecePriorityNone {
+				t.Fatalf("piece %d of ephemeral torrent requested with priority %s", i, p)
+			}
+		}
+	}
+}
+
+// TestCreateTorrentStays checks a created torrent is seeded from
+// where it was picked, though completed torrents get moved
+func TestCreateTorrentStays(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	e.mut.Lock()
+	e.config.CompletedDirectory = filepath.Join(dir, "completed")
+	e.mut.Unlock()
+	testMetainfo(t, dir, "shared", 100<<10)
+	created, err := e.CreateTorrent(CreateOptions{Path: "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if tr, err := e.GetTorrent(created.InfoHash); err == nil && tr.Done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("created torrent not found complete")
+		}
+	}
+	time.Sleep(time.Second)
+	if _, err := os.Stat(filepath.Join(dir, "shared")); err != nil {
+		t.Errorf("data of created torrent moved: %v", err)
+	}
+	if tr, err := e.GetTorrent(created.InfoHash); err != nil || tr.Directory != dir {
+		t.Errorf("created torrent not seeded from %s: %v", dir, err)
+	}
+}
+
+// TestSessionRestore checks a new engine on the same session directory
+// gets back every torrent, with its state and its place in the queue
+func TestSessionRestore(t *testing.T) {
+	e, dir, cleanup := newTestEngine(t)
+	defer cleanup()
+
+	var ihs []string
+	for _, name := range []string{"a", "b", "c"} {
+		mi := testMetainfo(t, dir, name, 16<<10)
+		if err := e.NewTorrent(torrent.TorrentSpecFromMetaInfo(mi), AddOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		ihs = append(ihs, mi.HashInfoBytes().HexString())
+	}
+	a, b, c := ihs[0], ihs[1], ihs[2]
+	//nobody has the metainfo of this one
+	var h metainfo.Hash
+	rand.Read(h[:])
+	m := h.HexString()
+	if err := e.NewMagnet(metainfo.Magnet{InfoHash: h, DisplayName: "m"}.String(), AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.SetCategory(Category{Name: "movies", DownloadLimit: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetTorrentCategory(b, "movies"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetTorrentTags(a, []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetTorrentSeedingGoals(a, 2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetTorrentRateLimits(b, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PauseTorrent(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.MoveInQueue(c, QueueTop); err != nil {
+		t.Fatal(err)
+	}
+	before := e.GetTorrents()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	session := filepath.Join(dir, ".session")
+	feeds := []byte(`{"feeds":[],"rules":[]}`)
+	if err := ioutil.WriteFile(filepath.Join(session, "feeds.json"), feeds, 0644); err != nil {
+		t.Fatal(err)
+	}
+	//a torrent without a position goes last
+	s, err := readState(e.statePath(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.QueuePosition = 0
+	sb, _ := json.Marshal(&s)
+	if err := writeFile(e.statePath(a), sb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(e.metainfoPath(m)); !os.IsNotExist(err) {
+		t.Fatalf("metainfo of the magnet saved: %v", err)
+	}
+
+	e = New()
+	if err := e.Configure(testConfig(t, dir)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	after := e.GetTorrents()
+	if len(after) != 4 {
+		t.Fatalf("expected 4 torrents restored, got %d", len(after))
+	}
+	for i, ih := range []string{c, b, m, a} {
+		tr := after[ih]
+		if tr == nil {
+			t.Fatalf("torrent %s not restored", ih)
+		}
+		if tr.QueuePosition != i+1 {
+			t.Errorf("torrent %s restored at %d, expected %d", ih, tr.QueuePosition, i+1)
+		}
+		if !tr.AddedAt.Equal(before[ih].AddedAt) {
+			t.Errorf("torrent %s added at %s, restored as %s", ih, before[ih].AddedAt, tr.AddedAt)
+		}
+	}
+	if tr := after[a]; len(tr.Tags) != 1 || tr.Tags[0] != "x" || tr.SeedRatio != 2 || tr.SeedTime != time.Hour {
+		t.Errorf("tags or seeding goals lost: %v, %v, %s", tr.Tags, tr.SeedRatio, tr.SeedTime)
+	}
+	if tr := after[b]; tr.Category != "movies" || tr.DownloadLimit != 1000 {
+		t.Errorf("category or download limit lost: %q, %d", tr.Category, tr.DownloadLimit)
+	}
+	if tr := after[c]; !tr.Paused || !tr.Done {
+		t.Errorf("expected paused and done, got paused: %v, done: %v", tr.Paused, tr.Done)
+	}
+	if tr := after[m]; tr.Loaded || !tr.Started {
+		t.Errorf("magnet restored loaded: %v, started: %v", tr.Loaded, tr.Started)
+	}
+	if cs := e.Categories(); len(cs) != 1 || cs[0].Name != "movies" || cs[0].DownloadLimit != 1<<20 {
+		t.Errorf("categories not restored: %+v", cs)
+	}
+	//the other files of the session directory are left alone
+	if got, err := ioutil.ReadFile(filepath.Join(session, "feeds.json")); err != nil || !bytes.Equal(got, feeds) {
+		t.Errorf("feeds.json changed: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,723 @@
+// Package enginetest provides an in-memory stand-in for the engine,
+// serving deterministic torrents and file contents, so that core and
+// its routes can be exercised without a network
+package enginetest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pooflix/engine"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Engine keeps torrents in memory, every torrent added with
+// AddTorrent or a .torrent is complete right away
+type Engine struct {
+	mut      sync.Mutex
+	config   engine.Config
+	ts       map[string]*engine.Torrent
+	trackers map[string][]engine.Tracker
+	//categories by name
+	categories map[string]engine.Category
+	//infohashes in queue order
+	queue []string
+	subs  map[chan engine.Event]struct{}
+}
+
+func New() *Engine {
+	return &Engine{
+		config: engine.Config{
+			AutoStart:     true,
+			EnableUpload:  true,
+			EnableSeeding: true,
+			IncomingPort:  50007,
+			ActiveProfile: engine.ProfileDefault,
+		},
+		ts:         map[string]*engine.Torrent{},
+		trackers:   map[string][]engine.Tracker{},
+		categories: map[string]engine.Category{},
+		subs:       map[chan engine.Event]struct{}{},
+	}
+}
+
+// InfoHash is the infohash AddTorrent gives a torrent named name
+func InfoHash(name string) string {
+	h := sha1.Sum([]byte(name))
+	return hex.EncodeToString(h[:])
+}
+
+// Content is what a file of the given path and size reads
+func Content(path string, size int64) []byte {
+	seed := sha1.Sum([]byte(path))
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = seed[i%len(seed)] ^ byte(i/len(seed))
+	}
+	return b
+}
+
+// AddTorrent adds a completed torrent with one file per size,
+// named <name>/<index>.bin, and returns its infohash
+func (e *Engine) AddTorrent(name string, sizes ...int64) (string, error) {
+	files := make([]*engine.File, len(sizes))
+	for i, size := range sizes {
+		files[i] = &engine.File{Path: fmt.Sprintf("%s/%d.bin", name, i), Size: size}
+	}
+	ih := InfoHash(name)
+	return ih, e.add(ih, name, files, engine.AddOptions{})
+}
+
+func (e *Engine) Config() engine.Config {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.config
+}
+
+func (e *Engine) Configure(c engine.Config) error {
+	if c.IncomingPort <= 0 || c.IncomingPort > 65535 {
+		return fmt.Errorf("invalid incoming port (%d)", c.IncomingPort)
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config = c
+	e.applySpeed()
+	return nil
+}
+
+// Close has nothing to save, the torrents are only kept in memory
+func (e *Engine) Close() error {
+	return nil
+}
+
+func (e *Engine) Subscribe() (events <-chan engine.Event, cancel func()) {
+	ch := make(chan engine.Event, 256)
+	e.mut.Lock()
+	e.subs[ch] = struct{}{}
+	e.mut.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.mut.Lock()
+			delete(e.subs, ch)
+			close(ch)
+			e.mut.Unlock()
+		})
+	}
+}
+
+// publish never blocks, e.mut must be held
+func (e *Engine) publish(typ engine.EventType, infohash string) {
+	ev := engine.Event{Type: typ, InfoHash: infohash, Time: time.Now()}
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (e *Engine) NewMagnet(magnetURI string, o engine.AddOptions) error {
+	m, err := metainfo.ParseMagnetURI(magnetURI)
+	if err != nil {
+		return err
+	}
+	return e.add(m.InfoHash.HexString(), m.DisplayName, nil, o)
+}
+
+func (e *Engine) NewTorrent(spec *torrent.TorrentSpec, o engine.AddOptions) error {
+	if spec.InfoBytes == nil {
+		return e.add(spec.InfoHash.HexString(), spec.DisplayName, nil, o)
+	}
+	var info metainfo.Info
+	if err := bencode.Unmarshal(spec.InfoBytes, &info); err != nil {
+		return err
+	}
+	var files []*engine.File
+	for _, fi := range info.UpvertedFiles() {
+		p := info.Name
+		if info.IsDir() {
+			p = strings.Join(append([]string{info.Name}, fi.Path...), "/")
+		}
+		files = append(files, &engine.File{Path: p, Size: fi.Length})
+	}
+	return e.add(spec.InfoHash.HexString(), info.Name, files, o)
+}
+
+// add registers a torrent, it is loaded and done
+// when its files are known
+func (e *Engine) add(ih, name string, files []*engine.File, o engine.AddOptions) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if _, ok := e.ts[ih]; ok {
+		return fmt.Errorf("torrent %s already added", ih)
+	}
+	if _, ok := e.categories[o.Category]; o.Category != "" && !ok {
+		return fmt.Errorf("missing category %s", o.Category)
+	}
+	t := &engine.Torrent{
+		InfoHash:  ih,
+		Name:      name,
+		Loaded:    files != nil,
+		Files:     files,
+		Started:   e.config.AutoStart,
+		Paused:    o.Paused,
+		Category:  o.Category,
+		Tags:      append([]string(nil), o.Tags...),
+		Ephemeral: o.Ephemeral,
+		AddedAt:   time.Now(),
+		ETA:       -1,
+	}
+	for _, f := range files {
+		f.Chunks = 1
+		f.Completed = 1
+		f.Started = true
+		f.Priority = engine.PriorityNormal
+		f.Percent = 100
+		t.Size += f.Size
+	}
+	if t.Loaded {
+		t.Downloaded = t.Size
+		t.Done = true
+		t.Percent = 100
+		t.ETA = 0
+	}
+	e.ts[ih] = t
+	e.queue = append(e.queue, ih)
+	e.renumber()
+	e.publish(engine.EventAdded, ih)
+	return nil
+}
+
+func (e *Engine) GetTorrents() map[string]*engine.Torrent {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	ts := make(map[string]*engine.Torrent, len(e.ts))
+	for ih, t := range e.ts {
+		ts[ih] = snapshot(t)
+	}
+	return ts
+}
+
+func (e *Engine) GetTorrent(infohash string) (*engine.Torrent, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot(t), nil
+}
+
+func snapshot(t *engine.Torrent) *engine.Torrent {
+	c := *t
+	c.Tags = append([]string(nil), t.Tags...)
+	c.Files = make([]*engine.File, len(t.Files))
+	for i, f := range t.Files {
+		fc := *f
+		c.Files[i] = &fc
+	}
+	return &c
+}
+
+// getTorrent looks up the torrent, e.mut must be held
+func (e *Engine) getTorrent(infohash string) (*engine.Torrent, error) {
+	t, ok := e.ts[strings.ToLower(infohash)]
+	if !ok {
+		return nil, fmt.Errorf("missing torrent %s", infohash)
+	}
+	return t, nil
+}
+
+// update applies fn to the torrent and publishes typ
+// when fn succeeds
+func (e *Engine) update(infohash string, typ engine.EventType, fn func(t *engine.Torrent) error) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if typ != "" {
+		e.publish(typ, t.InfoHash)
+	}
+	return nil
+}
+
+func (e *Engine) StartTorrent(infohash string) error {
+	return e.update(infohash, engine.EventStarted, func(t *engine.Torrent) error {
+		if t.Started {
+			return fmt.Errorf("already started")
+		}
+		t.Started = true
+		t.Paused = false
+		return nil
+	})
+}
+
+func (e *Engine) StopTorrent(infohash string) error {
+	return e.update(infohash, engine.EventStopped, func(t *engine.Torrent) error {
+		if !t.Started {
+			return fmt.Errorf("already stopped")
+		}
+		t.Started = false
+		return nil
+	})
+}
+
+func (e *Engine) PauseTorrent(infohash string) error {
+	return e.update(infohash, engine.EventPaused, func(t *engine.Torrent) error {
+		if t.Paused {
+			return fmt.Errorf("already paused")
+		}
+		t.Paused = true
+		return nil
+	})
+}
+
+func (e *Engine) ResumeTorrent(infohash string) error {
+	return e.update(infohash, engine.EventStarted, func(t *engine.Torrent) error {
+		if !t.Paused {
+			return fmt.Errorf("not paused")
+		}
+		t.Paused = false
+		return nil
+	})
+}
+
+// DeleteTorrent removes the torrent, there is no data to delete
+func (e *Engine) DeleteTorrent(infohash string, deleteData bool) error {
+	return e.update(infohash, engine.EventRemoved, func(t *engine.Torrent) error {
+		delete(e.ts, t.InfoHash)
+		delete(e.trackers, t.InfoHash)
+		for i, ih := range e.queue {
+			if ih == t.InfoHash {
+				e.queue = append(e.queue[:i], e.queue[i+1:]...)
+				break
+			}
+		}
+		e.renumber()
+		return nil
+	})
+}
+
+// RecheckTorrent finds every piece intact right away
+func (e *Engine) RecheckTorrent(infohash string) error {
+	return e.update(infohash, engine.EventChecked, func(t *engine.Torrent) error {
+		if !t.Loaded {
+			return fmt.Errorf("metadata of %s not yet known", t.InfoHash)
+		}
+		t.CheckProgress = 100
+		return nil
+	})
+}
+
+// MoveStorage only records the new directory, relative
+// to the storage root or the download directory
+func (e *Engine) MoveStorage(infohash, dir string) error {
+	return e.update(infohash, engine.EventMoved, func(t *engine.Torrent) error {
+		root := e.config.StorageRoot
+		if root == "" {
+			root = e.config.DownloadDirectory
+		}
+		t.Directory = filepath.Join(root, filepath.FromSlash(dir))
+		return nil
+	})
+}
+
+func (e *Engine) Categories() []engine.Category {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	categories := make([]engine.Category, 0, len(e.categories))
+	for _, c := range e.categories {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Name < categories[j].Name
+	})
+	return categories
+}
+
+func (e *Engine) SetCategory(c engine.Category) error {
+	if c.Name == "" {
+		return fmt.Errorf("missing category name")
+	}
+	if c.DownloadLimit < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.categories[c.Name] = c
+	return nil
+}
+
+func (e *Engine) RemoveCategory(name string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if _, ok := e.categories[name]; !ok {
+		return fmt.Errorf("missing category %s", name)
+	}
+	delete(e.categories, name)
+	for _, t := range e.ts {
+		if t.Category == name {
+			t.Category = ""
+		}
+	}
+	return nil
+}
+
+func (e *Engine) SetTorrentCategory(infohash, category string) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		if _, ok := e.categories[category]; category != "" && !ok {
+			return fmt.Errorf("missing category %s", category)
+		}
+		t.Category = category
+		return nil
+	})
+}
+
+func (e *Engine) SetTorrentTags(infohash string, tags []string) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		t.Tags = append([]string(nil), tags...)
+		return nil
+	})
+}
+
+// CreateTorrent adds a completed torrent named after the
+// last element of o.Path, with a single file of 1MiB
+func (e *Engine) CreateTorrent(o engine.CreateOptions) (*engine.CreatedTorrent, error) {
+	if c := e.Config(); !c.EnableUpload || !c.EnableSeeding {
+		return nil, fmt.Errorf("uploading and seeding must be enabled to share a created torrent")
+	}
+	name := path.Base(o.Path)
+	ih, err := e.AddTorrent(name, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	return &engine.CreatedTorrent{
+		InfoHash: ih,
+		Magnet:   "magnet:?xt=urn:btih:" + ih + "&dn=" + url.QueryEscape(name),
+	}, nil
+}
+
+// Metainfo returns a .torrent listing the files of the torrent,
+// without piece hashes
+func (e *Engine) Metainfo(infohash string) ([]byte, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Loaded {
+		return nil, fmt.Errorf("metadata of %s not yet known", t.InfoHash)
+	}
+	info := metainfo.Info{Name: t.Name, PieceLength: 256 << 10}
+	for _, f := range t.Files {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: f.Size,
+			Path:   strings.Split(strings.TrimPrefix(f.Path, t.Name+"/"), "/"),
+		})
+	}
+	mi := metainfo.MetaInfo{}
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// file looks up a file of t by its path
+func file(t *engine.Torrent, path string) (*engine.File, error) {
+	for _, f := range t.Files {
+		if f.Path == path {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("missing file %s", path)
+}
+
+func (e *Engine) SetFilePriority(infohash, filepath string, p engine.Priority) error {
+	if _, err := engine.ParsePriority(string(p)); err != nil {
+		return err
+	}
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		f, err := file(t, filepath)
+		if err != nil {
+			return err
+		}
+		f.Priority = p
+		f.Started = p != engine.PrioritySkip
+		return nil
+	})
+}
+
+func (e *Engine) SetTorrentStreaming(infohash string, on bool) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		t.Streaming = on
+		return nil
+	})
+}
+
+func (e *Engine) SetFileStreaming(infohash, filepath string, on bool) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		f, err := file(t, filepath)
+		if err != nil {
+			return err
+		}
+		f.Streaming = on
+		return nil
+	})
+}
+
+// fileReader reads the Content of a file
+type fileReader struct {
+	*bytes.Reader
+	file *engine.File
+}
+
+func (r *fileReader) File() *engine.File {
+	return r.file
+}
+
+func (r *fileReader) Close() error {
+	return nil
+}
+
+func (e *Engine) NewFileReader(infohash string, id int) (engine.FileReader, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	if id < 0 || id >= len(t.Files) {
+		return nil, fmt.Errorf("missing file %d", id)
+	}
+	f := *t.Files[id]
+	return &fileReader{bytes.NewReader(Content(f.Path, f.Size)), &f}, nil
+}
+
+func (e *Engine) SetRateLimits(download, upload int64) error {
+	if download < 0 || upload < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.DownloadRate = download
+	e.config.UploadRate = upload
+	e.applySpeed()
+	return nil
+}
+
+// SetAltSpeed switches between the alternative and the default
+// profile, the schedule is never followed
+func (e *Engine) SetAltSpeed(on bool) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.AltSpeed = on
+	e.applySpeed()
+	return nil
+}
+
+// DiskSpace reports the quota and sizes of the torrents,
+// the disk is never low on space
+func (e *Engine) DiskSpace() (engine.DiskSpace, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	var used int64
+	for _, t := range e.ts {
+		used += t.Size
+	}
+	return engine.DiskSpace{
+		Used:          used,
+		Quota:         e.config.DownloadQuota,
+		MinFree:       e.config.MinFreeSpace,
+		QuotaExceeded: e.config.DownloadQuota > 0 && used > e.config.DownloadQuota,
+	}, nil
+}
+
+// applySpeed sets the active profile, e.mut must be held
+func (e *Engine) applySpeed() {
+	profile := engine.ProfileDefault
+	if e.config.AltSpeed {
+		profile = engine.ProfileAlternative
+	}
+	if profile != e.config.ActiveProfile {
+		e.config.ActiveProfile = profile
+		e.publish(engine.EventSpeedProfile, "")
+	}
+	for _, t := range e.ts {
+		e.updateLimits(t)
+	}
+}
+
+// speed is the global limits of the active profile
+func (e *Engine) speed() (download, upload int64) {
+	if e.config.AltSpeed {
+		return e.config.AltDownloadRate, e.config.AltUploadRate
+	}
+	return e.config.DownloadRate, e.config.UploadRate
+}
+
+func (e *Engine) SetTorrentRateLimits(infohash string, download int64) error {
+	if download < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		t.DownloadLimit = download
+		e.updateLimits(t)
+		return nil
+	})
+}
+
+// updateLimits works out the effective limits of t, e.mut must be held
+func (e *Engine) updateLimits(t *engine.Torrent) {
+	download, upload := e.speed()
+	t.EffectiveDownloadLimit = effectiveLimit(download, t.DownloadLimit)
+	t.EffectiveUploadLimit = upload
+}
+
+func effectiveLimit(global, local int64) int64 {
+	if global <= 0 || (local > 0 && local < global) {
+		return local
+	}
+	return global
+}
+
+func (e *Engine) SetSeedingGoals(ratio float32, seedTime time.Duration) error {
+	if ratio < 0 || seedTime < 0 {
+		return fmt.Errorf("invalid seeding goal")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.SeedRatio = ratio
+	e.config.SeedTime = seedTime
+	return nil
+}
+
+func (e *Engine) SetTorrentSeedingGoals(infohash string, ratio float32, seedTime time.Duration) error {
+	if ratio < 0 || seedTime < 0 {
+		return fmt.Errorf("invalid seeding goal")
+	}
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		t.SeedRatio = ratio
+		t.SeedTime = seedTime
+		t.SeedingGoalReached = false
+		return nil
+	})
+}
+
+func (e *Engine) SetQueueLimits(downloads, seeds int) error {
+	if downloads < 0 || seeds < 0 {
+		return fmt.Errorf("invalid queue limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.MaxActiveDownloads = downloads
+	e.config.MaxActiveSeeds = seeds
+	return nil
+}
+
+func (e *Engine) MoveInQueue(infohash, move string) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		i := t.QueuePosition - 1
+		var j int
+		switch move {
+		case engine.QueueUp:
+			j = i - 1
+		case engine.QueueDown:
+			j = i + 1
+		case engine.QueueTop:
+			j = 0
+		case engine.QueueBottom:
+			j = len(e.queue) - 1
+		default:
+			return fmt.Errorf("invalid queue move (%s)", move)
+		}
+		if j < 0 || j >= len(e.queue) || j == i {
+			return nil
+		}
+		q := append(e.queue[:i:i], e.queue[i+1:]...)
+		e.queue = append(q[:j:j], append([]string{t.InfoHash}, q[j:]...)...)
+		e.renumber()
+		return nil
+	})
+}
+
+// renumber sets the queue positions, e.mut must be held
+func (e *Engine) renumber() {
+	for i, ih := range e.queue {
+		e.ts[ih].QueuePosition = i + 1
+	}
+}
+
+func (e *Engine) Trackers(infohash string) ([]engine.Tracker, error) {
+	var trackers []engine.Tracker
+	err := e.update(infohash, "", func(t *engine.Torrent) error {
+		trackers = append([]engine.Tracker{}, e.trackers[t.InfoHash]...)
+		return nil
+	})
+	return trackers, err
+}
+
+func (e *Engine) AddTracker(infohash, u string, tier int) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		last := -1
+		for _, tr := range e.trackers[t.InfoHash] {
+			if tr.URL == u {
+				return fmt.Errorf("tracker already added")
+			}
+			if tr.Tier > last {
+				last = tr.Tier
+			}
+		}
+		if tier < 0 || tier > last+1 {
+			tier = last + 1
+		}
+		e.trackers[t.InfoHash] = append(e.trackers[t.InfoHash], engine.Tracker{URL: u, Tier: tier})
+		return nil
+	})
+}
+
+func (e *Engine) RemoveTracker(infohash, u string) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		trackers := e.trackers[t.InfoHash]
+		for i, tr := range trackers {
+			if tr.URL == u {
+				e.trackers[t.InfoHash] = append(trackers[:i:i], trackers[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("missing tracker %s", u)
+	})
+}
+
+// Reannounce records an announce to every tracker, without any peers
+func (e *Engine) Reannounce(infohash string) error {
+	return e.update(infohash, "", func(t *engine.Torrent) error {
+		now := time.Now()
+		for i := range e.trackers[t.InfoHash] {
+			tr := &e.trackers[t.InfoHash][i]
+			tr.LastAnnounce = now
+			tr.NextAnnounce = now.Add(30 * time.Minute)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/labstack/gommon/log"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventAdded          EventType = "added"
+	EventMetadata       EventType = "metadata"
+	EventStarted        EventType = "started"
+	EventStopped        EventType = "stopped"
+	EventPaused         EventType = "paused"
+	EventChecking       EventType = "checking"
+	EventChecked        EventType = "checked"
+	EventMoved          EventType = "moved"
+	EventPieceCompleted EventType = "piece_completed"
+	EventFileCompleted  EventType = "file_completed"
+	EventCompleted      EventType = "completed"
+	EventError          EventType = "error"
+	EventRemoved        EventType = "removed"
+	//the active speed profile changed, see Config
+	EventSpeedProfile EventType = "speed_profile"
+	//downloads got held back for low disk space or went on, see DiskSpace
+	EventDiskSpace EventType = "disk_space"
+)
+
+// Event is published by the engine whenever a torrent, the
+// active speed profile or the disk space state changes
+type Event struct {
+	Type     EventType
+	InfoHash string
+	Time     time.Time
+	Piece    int    `json:",omitempty"`
+	File     string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// subscriberBuffer is how many events a subscriber may lag
+// behind before further events are dropped for it
+const subscriberBuffer = 256
+
+type bus struct {
+	mut  sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving every event published
+// from now on, cancel must be called once done with it
+func (e *Engine) Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, subscriberBuffer)
+	e.bus.mut.Lock()
+	if e.bus.subs == nil {
+		e.bus.subs = map[chan Event]struct{}{}
+	}
+	e.bus.subs[ch] = struct{}{}
+	e.bus.mut.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.bus.mut.Lock()
+			delete(e.bus.subs, ch)
+			close(ch)
+			e.bus.mut.Unlock()
+		})
+	}
+}
+
+// publish never blocks, the engine lock may be held
+func (e *Engine) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.bus.mut.Lock()
+	defer e.bus.mut.Unlock()
+	for ch := range e.bus.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// fail logs err and publishes it as an error of the torrent
+func (e *Engine) fail(infohash, what string, err error) {
+	log.Warnf("Engine: %s <%s>: %v", what, infohash, err)
+	e.publish(Event{Type: EventError, InfoHash: infohash, Error: fmt.Sprintf("%s: %v", what, err)})
+}
+
+// watch follows tt for as long as it is loaded, it applies the saved
+// file priorities once the info is known and turns piece state changes
+// into completion events
+func (e *Engine) watch(t *Torrent, tt *torrent.Torrent, s torrentState) {
+	select {
+	case <-tt.GotInfo():
+	case <-tt.Closed():
+		return
+	}
+	e.mut.Lock()
+	if e.ts[t.InfoHash] != t || closed(tt) {
+		//deleted, or carried over to a new client, along with the info
+		e.mut.Unlock()
+		return
+	}
+	t.Update(tt)
+	e.restoreFiles(t, s)
+	if s.InfoHash == "" && s.Magnet != "" {
+		//added by magnet, its size is only known now
+		e.checkMetadata(t)
+	}
+	//the torrent is only known to be done now
+	t.active = false
+	e.manageQueue()
+	if err := e.saveState(t); err != nil {
+		e.fail(t.InfoHash, "failed to save torrent", err)
+	}
+	e.mut.Unlock()
+	e.publish(Event{Type: EventMetadata, InfoHash: t.InfoHash})
+
+	sub := tt.SubscribePieceStateChanges()
+	defer sub.Close()
+	tfiles := tt.Files()
+	pieceLength := tt.Info().PieceLength
+	completed := make([]bool, len(tfiles))
+	for i, f := range tfiles {
+		completed[i] = bytesCompleted(f) == f.Length()
+	}
+	done := e.done(t, completed)
+	for {
+		select {
+		case <-tt.Closed():
+			return
+		case v, ok := <-sub.Values:
+			if !ok {
+				return
+			}
+			c := v.(torrent.PieceStateChange)
+			if !c.Complete {
+				continue
+			}
+			e.publish(Event{Type: EventPieceCompleted, InfoHash: t.InfoHash, Piece: c.Index})
+			for i, f := range tfiles {
+				first := int(f.Offset() / pieceLength)
+				last := int((f.Offset() + f.Length() - 1) / pieceLength)
+				if completed[i] || c.Index < first || c.Index > last {
+					continue
+				}
+				if bytesCompleted(f) == f.Length() {
+					completed[i] = true
+					e.publish(Event{Type: EventFileCompleted, InfoHash: t.InfoHash, File: f.Path()})
+				}
+			}
+			if d := e.done(t, completed); d != done {
+				done = d
+				if done {
+					log.Infof("Engine: Torrent <%s> completed.", tt.Name())
+					e.publish(Event{Type: EventCompleted, InfoHash: t.InfoHash})
+					go e.moveCompleted(t.InfoHash)
+				}
+			}
+		}
+	}
+}
+
+// closed tells whether tt got dropped, or its client closed
+func closed(tt *torrent.Torrent) bool {
+	select {
+	case <-tt.Closed():
+		return true
+	default:
+		return false
+	}
+}
+
+// bytesCompleted sums the complete pieces of f, as far as they are in f
+func bytesCompleted(f *torrent.File) int64 {
+	var n int64
+	for _, p := range f.State() {
+		if p.Complete {
+			n += p.Bytes
+		}
+	}
+	return n
+}
+
+// done tells whether every file that is not skipped is completed
+func (e *Engine) done(t *Torrent, completed []bool) bool {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	for i, f := range t.Files {
+		if f != nil && i < len(completed) && f.Priority != PrioritySkip && !completed[i] {
+			return false
+		}
+	}
+	return true
+}
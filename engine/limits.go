@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+// rateBurst must hold at least one chunk, anacrolix
+// refuses to upload with a smaller burst
+const rateBurst = 256 << 10
+
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(toLimit(bytesPerSecond), rateBurst)
+}
+
+func toLimit(bytesPerSecond int64) rate.Limit {
+	if bytesPerSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+// effectiveLimit is the lower of the two limits, 0 meaning unlimited
+func effectiveLimit(global, local int64) int64 {
+	if global <= 0 || (local > 0 && local < global) {
+		return local
+	}
+	return global
+}
+
+// SetRateLimits changes the default global limits in bytes per second
+// of the running client, 0 removes a limit. They apply whenever no
+// other speed profile is active.
+func (e *Engine) SetRateLimits(download, upload int64) error {
+	if download < 0 || upload < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.DownloadRate = download
+	e.config.UploadRate = upload
+	e.applySpeed(time.Now())
+	return nil
+}
+
+// SetTorrentRateLimits overrides the global download limit for a single
+// torrent, 0 falls back to the global limit. Uploads only have a global
+// limit: anacrolix reads the data it uploads while holding its client
+// lock, throttling those reads the way limitedPiece throttles writes
+// would stall every torrent.
+func (e *Engine) SetTorrentRateLimits(infohash string, download int64) error {
+	if download < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.DownloadLimit = download
+	e.updateLimits(t)
+	return e.saveState(t)
+}
+
+// updateLimits applies the limits of t, e.mut must be held
+func (e *Engine) updateLimits(t *Torrent) {
+	download := e.torrentLimit(t)
+	t.EffectiveDownloadLimit = effectiveLimit(e.speedDownload, download)
+	t.EffectiveUploadLimit = e.speedUpload
+
+	e.limiterMut.Lock()
+	defer e.limiterMut.Unlock()
+	l, ok := e.limiters[t.InfoHash]
+	switch {
+	case download <= 0:
+		delete(e.limiters, t.InfoHash)
+	case ok:
+		l.SetLimit(toLimit(download))
+	default:
+		e.limiters[t.InfoHash] = newLimiter(download)
+	}
+}
+
+// torrentLimiter is called by the storage from within anacrolix,
+// which is called into with e.mut held, so it must never wait for e.mut
+func (e *Engine) torrentLimiter(ih metainfo.Hash) *rate.Limiter {
+	e.limiterMut.RLock()
+	defer e.limiterMut.RUnlock()
+	return e.limiters[ih.HexString()]
+}
+
+// limitedStorage throttles writes of torrents that have
+// their own download limit
+type limitedStorage struct {
+	storage.ClientImpl
+	limiter func(metainfo.Hash) *rate.Limiter
+}
+
+func (s limitedStorage) OpenTorrent(info *metainfo.Info, ih metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.ClientImpl.OpenTorrent(info, ih)
+	if err != nil {
+		return nil, err
+	}
+	return limitedTorrent{t, func() *rate.Limiter { return s.limiter(ih) }}, nil
+}
+
+type limitedTorrent struct {
+	storage.TorrentImpl
+	limiter func() *rate.Limiter
+}
+
+func (t limitedTorrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return limitedPiece{t.TorrentImpl.Piece(p), t.limiter}
+}
+
+type limitedPiece struct {
+	storage.PieceImpl
+	limiter func() *rate.Limiter
+}
+
+func (p limitedPiece) WriteAt(b []byte, off int64) (int, error) {
+	if l := p.limiter(); l != nil {
+		for n := len(b); n > 0; {
+			k := n
+			if k > l.Burst() {
+				k = l.Burst()
+			}
+			if err := l.WaitN(context.Background(), k); err != nil {
+				return 0, err
+			}
+			n -= k
+		}
+	}
+	return p.PieceImpl.WriteAt(b, off)
+}
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"io"
+)
+
+// LoadTorrentSpec parses and validates metainfo read from r
+func LoadTorrentSpec(r io.Reader) (*torrent.TorrentSpec, error) {
+	mi, err := metainfo.Load(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metainfo: %v", err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, fmt.Errorf("invalid info: %v", err)
+	}
+	if info.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length (%d)", info.PieceLength)
+	}
+	if len(info.Pieces) == 0 || len(info.Pieces)%20 != 0 {
+		return nil, fmt.Errorf("invalid pieces length (%d)", len(info.Pieces))
+	}
+	total := info.TotalLength()
+	if total <= 0 {
+		return nil, fmt.Errorf("empty torrent")
+	}
+	if n := (total + info.PieceLength - 1) / info.PieceLength; int64(info.NumPieces()) != n {
+		return nil, fmt.Errorf("expected %d pieces, got %d", n, info.NumPieces())
+	}
+	return torrent.TorrentSpecFromMetaInfo(mi), nil
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/labstack/gommon/log"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MoveStorage moves the data of the torrent into dir, relative to
+// the storage root, the torrent is seeded from there on
+func (e *Engine) MoveStorage(infohash, dir string) error {
+	c := e.Config()
+	root := c.StorageRoot
+	if root == "" {
+		root = c.DownloadDirectory
+	}
+	base, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	to := filepath.Join(base, filepath.FromSlash(dir))
+	if !within(base, to) {
+		return fmt.Errorf("invalid path (%s)", dir)
+	}
+	return e.moveStorage(infohash, to)
+}
+
+// moveStorage takes the torrent off the client, so nothing writes
+// to its files while they are moved, and adds it again afterwards
+func (e *Engine) moveStorage(infohash, to string) error {
+	e.mut.Lock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		e.mut.Unlock()
+		return err
+	}
+	if t.t == nil || t.t.Info() == nil {
+		e.mut.Unlock()
+		return fmt.Errorf("metadata of %s not yet known", t.InfoHash)
+	}
+	if t.Ephemeral {
+		e.mut.Unlock()
+		return fmt.Errorf("ephemeral torrent %s has no storage to move", t.InfoHash)
+	}
+	from := t.Directory
+	if filepath.Clean(from) == filepath.Clean(to) {
+		e.mut.Unlock()
+		return nil
+	}
+	s := t.state()
+	mi := t.t.Metainfo()
+	name := t.t.Info().Name
+	position := e.queueIndex(t.InfoHash)
+	t.t.Drop()
+	delete(e.ts, t.InfoHash)
+	e.dequeue(t.InfoHash)
+	e.manageQueue()
+	client := e.client
+	e.mut.Unlock()
+
+	log.Infof("Engine: Moving <%s> from %s to %s.", name, from, to)
+	moveErr := moveData(filepath.Join(from, name), filepath.Join(to, name))
+	if moveErr == nil {
+		s.DataDirectory = to
+	}
+	//the torrent comes back either way, in its old place when moving failed
+	tt, err := e.addTorrent(client, &mi, s)
+	if err == nil {
+		err = e.newTorrent(tt, s)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add moved torrent: %v", err)
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if position >= 0 && position < len(e.queue) {
+		e.dequeue(t.InfoHash)
+		e.queue = append(e.queue[:position:position], append([]string{t.InfoHash}, e.queue[position:]...)...)
+		e.manageQueue()
+	}
+	if t, ok := e.ts[t.InfoHash]; ok {
+		if err := e.saveState(t); err != nil {
+			return err
+		}
+	}
+	if moveErr != nil {
+		return fmt.Errorf("failed to move data: %v", moveErr)
+	}
+	e.publish(Event{Type: EventMoved, InfoHash: infohash})
+	return nil
+}
+
+// moveCompleted moves a torrent that just got done into the save path
+// of its category or the completed directory, a created torrent is only
+// done once its data got checked and is shared from where it is
+func (e *Engine) moveCompleted(infohash string) {
+	e.mut.Lock()
+	dir := e.config.CompletedDirectory
+	if t, err := e.getTorrent(infohash); err == nil {
+		if t.Ephemeral || t.created {
+			e.mut.Unlock()
+			return
+		}
+		if c, ok := e.categories[t.Category]; ok && c.SavePath != "" {
+			dir = c.SavePath
+		}
+	}
+	e.mut.Unlock()
+	if dir == "" {
+		return
+	}
+	if err := e.moveStorage(infohash, dir); err != nil {
+		e.fail(infohash, "failed to move completed torrent", err)
+	}
+}
+
+// moveData moves the file or directory at src to dst, by renaming
+// it or, across devices, by copying it
+func moveData(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		//nothing downloaded yet
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyData(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyData(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		}
+		return copyFile(path, target, fi.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// resolvePath joins p to dir, the result must lie inside of dir
+func resolvePath(dir, p string) (string, error) {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(base, filepath.FromSlash(p))
+	if path == base || !within(base, path) {
+		return "", fmt.Errorf("invalid path (%s)", p)
+	}
+	return path, nil
+}
+
+// within tells whether path is dir or lies inside of it,
+// both must be clean
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeData removes the files at paths, relative to dir, and the
+// directories they leave empty. Nothing outside of dir is removed,
+// not even when reached through a symbolic link.
+func removeData(dir string, paths []string) error {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if base, err = filepath.EvalSymlinks(base); err != nil {
+		return err
+	}
+	var first error
+	dirs := map[string]bool{}
+	for _, p := range paths {
+		path, err := resolvePath(base, p)
+		if err == nil {
+			err = removeFile(base, path)
+		}
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		for d := filepath.Dir(path); d != base && within(base, d); d = filepath.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	//deepest first, directories still holding anything stay
+	sorted := make([]string, 0, len(dirs))
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	for _, d := range sorted {
+		if real, err := filepath.EvalSymlinks(d); err == nil && within(base, real) {
+			os.Remove(d)
+		}
+	}
+	return first
+}
+
+// removeFile removes the file at path, its directory
+// must really be inside of base
+func removeFile(base, path string) error {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !within(base, parent) {
+		return fmt.Errorf("%s is outside of %s", path, base)
+	}
+	err = os.Remove(filepath.Join(parent, filepath.Base(path)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates the files at paths, relative to dir
+func writeFiles(t *testing.T, dir string, paths ...string) {
+	for _, p := range paths {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectExists(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(p))); err != nil {
+			t.Errorf("%s removed: %v", p, err)
+		}
+	}
+}
+
+func expectRemoved(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(p))); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", p, err)
+		}
+	}
+}
+
+// newSaveDir returns a temporary directory holding the save path
+// "save", paths outside of it are relative to the directory
+func newSaveDir(t *testing.T) (dir, save string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	save = filepath.Join(dir, "save")
+	if err := os.Mkdir(save, 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, save, func() { os.RemoveAll(dir) }
+}
+
+func TestRemoveDataSharedParent(t *testing.T) {
+	dir, save, cleanup := newSaveDir(t)
+	defer cleanup()
+	writeFiles(t, save, "show/a.mkv", "show/sub/b.mkv", "show/other.mkv", "movie/c/d.mkv")
+
+	if err := removeData(save, []string{"show/a.mkv", "show/sub/b.mkv", "movie/c/d.mkv"}); err != nil {
+		t.Fatal(err)
+	}
+	expectRemoved(t, save, "show/a.mkv", "show/sub", "movie")
+	//the directory still holds a file of no torrent
+	expectExists(t, save, "show/other.mkv")
+	expectExists(t, dir, "save")
+}
+
+func TestRemoveDataDotDot(t *testing.T) {
+	dir, save, cleanup := newSaveDir(t)
+	defer cleanup()
+	writeFiles(t, dir, "outside.mkv", "other/e.mkv")
+	writeFiles(t, save, "f.mkv")
+
+	err := removeData(save, []string{"../outside.mkv", "sub/../../other/e.mkv", "f.mkv"})
+	if err == nil {
+		t.Error("paths outside of the save path not refused")
+	}
+	expectExists(t, dir, "outside.mkv", "other/e.mkv")
+	//the other files are removed all the same
+	expectRemoved(t, save, "f.mkv")
+}
+
+func TestRemoveDataSymlink(t *testing.T) {
+	dir, save, cleanup := newSaveDir(t)
+	defer cleanup()
+	writeFiles(t, dir, "outside/g.mkv", "secret.mkv")
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(save, "link")); err != nil {
+		t.Skipf("no symbolic links: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.mkv"), filepath.Join(save, "h.mkv")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeData(save, []string{"link/g.mkv"}); err == nil {
+		t.Error("file behind a symbolic link out of the save path not refused")
+	}
+	expectExists(t, dir, "outside/g.mkv", "save/link")
+
+	//a linked file is unlinked, what it links to stays
+	if err := removeData(save, []string{"h.mkv"}); err != nil {
+		t.Fatal(err)
+	}
+	expectRemoved(t, save, "h.mkv")
+	expectExists(t, dir, "secret.mkv")
+}
+
+func TestRemoveDataSymlinkedSaveDir(t *testing.T) {
+	dir, save, cleanup := newSaveDir(t)
+	defer cleanup()
+	writeFiles(t, save, "show/a.mkv")
+	//the save path itself may be reached through a link
+	linked := filepath.Join(dir, "linked")
+	if err := os.Symlink(save, linked); err != nil {
+		t.Skipf("no symbolic links: %v", err)
+	}
+
+	if err := removeData(linked, []string{"show/a.mkv"}); err != nil {
+		t.Fatal(err)
+	}
+	expectRemoved(t, save, "show")
+	expectExists(t, dir, "save", "linked")
+}
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/anacrolix/torrent"
+)
+
+// Priority of a file inside its torrent
+type Priority string
+
+const (
+	PrioritySkip   Priority = "skip"
+	PriorityNormal Priority = "normal"
+	PriorityHigh   Priority = "high"
+	PriorityNow    Priority = "now"
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(s); p {
+	case PrioritySkip, PriorityNormal, PriorityHigh, PriorityNow:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid priority (%s)", s)
+}
+
+// UnmarshalJSON also accepts the plain booleans
+// older sessions used for the file selection
+func (p *Priority) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true":
+		*p = PriorityNormal
+		return nil
+	case "false":
+		*p = PrioritySkip
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParsePriority(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+func (p Priority) apply(f *torrent.File) {
+	switch p {
+	case PrioritySkip:
+		f.SetPriority(torrent.PiecePriorityNone)
+	case PriorityHigh:
+		f.SetPriority(torrent.PiecePriorityHigh)
+	case PriorityNow:
+		f.SetPriority(torrent.PiecePriorityNow)
+	default:
+		f.SetPriority(torrent.PiecePriorityNormal)
+	}
+}
@@ -0,0 +1,134 @@
+package engine
+
+import "fmt"
+
+// moves of a torrent inside the queue
+const (
+	QueueUp     = "up"
+	QueueDown   = "down"
+	QueueTop    = "top"
+	QueueBottom = "bottom"
+)
+
+// SetQueueLimits changes how many torrents may download and
+// seed at the same time, 0 is unlimited
+func (e *Engine) SetQueueLimits(downloads, seeds int) error {
+	if downloads < 0 || seeds < 0 {
+		return fmt.Errorf("invalid queue limit")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.MaxActiveDownloads = downloads
+	e.config.MaxActiveSeeds = seeds
+	e.manageQueue()
+	return nil
+}
+
+// MoveInQueue moves the torrent up, down, to the top or
+// to the bottom of the queue
+func (e *Engine) MoveInQueue(infohash, move string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	i := e.queueIndex(t.InfoHash)
+	if i < 0 {
+		return fmt.Errorf("torrent %s not queued", t.InfoHash)
+	}
+	var j int
+	switch move {
+	case QueueUp:
+		j = i - 1
+	case QueueDown:
+		j = i + 1
+	case QueueTop:
+		j = 0
+	case QueueBottom:
+		j = len(e.queue) - 1
+	default:
+		return fmt.Errorf("invalid queue move (%s)", move)
+	}
+	if j < 0 || j >= len(e.queue) || j == i {
+		return nil
+	}
+	q := append(e.queue[:i:i], e.queue[i+1:]...)
+	e.queue = append(q[:j:j], append([]string{t.InfoHash}, q[j:]...)...)
+	e.manageQueue()
+	//every torrent in between changed its position
+	for _, ih := range e.queue {
+		if err := e.saveState(e.ts[ih]); err != nil {
+			e.fail(ih, "failed to save torrent", err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) queueIndex(infohash string) int {
+	for i, ih := range e.queue {
+		if ih == infohash {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *Engine) dequeue(infohash string) {
+	if i := e.queueIndex(infohash); i >= 0 {
+		e.queue = append(e.queue[:i], e.queue[i+1:]...)
+	}
+}
+
+// manageQueue hands out the download and seed slots in queue
+// order, torrents without a slot are queued, which keeps them
+// disconnected the same way a paused torrent is.
+// e.mut must be held.
+func (e *Engine) manageQueue() {
+	downloads, seeds := 0, 0
+	for i, ih := range e.queue {
+		t, ok := e.ts[ih]
+		if !ok {
+			continue
+		}
+		t.QueuePosition = i + 1
+		if !t.Started || t.Paused || t.t == nil {
+			if t.Queued && !t.Paused {
+				t.setMaxConns(e.maxConns)
+			}
+			t.Queued = false
+			t.active = false
+			continue
+		}
+		//metadata is always fetched, slots are handed out
+		//once it is known what the torrent downloads
+		if !t.Loaded {
+			continue
+		}
+		var slot bool
+		if t.Done {
+			seeds++
+			slot = e.config.MaxActiveSeeds <= 0 || seeds <= e.config.MaxActiveSeeds
+		} else {
+			downloads++
+			//no download gets a slot while the disk is low on space or the quota is exceeded
+			slot = !e.diskLow && !e.quotaExceeded && (e.config.MaxActiveDownloads <= 0 || downloads <= e.config.MaxActiveDownloads)
+		}
+		switch {
+		case slot && !t.active:
+			if t.Queued {
+				t.Queued = false
+				t.setMaxConns(e.maxConns)
+			}
+			t.active = true
+			e.download(t)
+			t.reannounce()
+		case !slot && (t.active || !t.Queued):
+			t.active = false
+			t.Queued = true
+			e.cancelDownload(t)
+			t.setMaxConns(0)
+			t.reannounce()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/labstack/gommon/log"
+)
+
+// RecheckTorrent hashes every piece of the torrent again, pieces
+// that fail are downloaded again as long as the torrent is active
+func (e *Engine) RecheckTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if t.t == nil || t.t.Info() == nil {
+		return fmt.Errorf("metadata of %s not yet known", t.InfoHash)
+	}
+	if t.Checking {
+		return fmt.Errorf("already checking")
+	}
+	t.Checking = true
+	t.CheckProgress = 0
+	go e.recheck(t, t.t)
+	e.publish(Event{Type: EventChecking, InfoHash: t.InfoHash})
+	return nil
+}
+
+// recheck verifies the pieces of tt one by one, keeping
+// track of the progress in t
+func (e *Engine) recheck(t *Torrent, tt *torrent.Torrent) {
+	n := tt.NumPieces()
+	for i := 0; i < n; i++ {
+		select {
+		case <-tt.Closed():
+			return
+		default:
+		}
+		tt.Piece(i).VerifyData()
+		e.mut.Lock()
+		t.CheckProgress = percent(int64(i+1), int64(n))
+		e.mut.Unlock()
+	}
+
+	e.mut.Lock()
+	t.Checking = false
+	if e.ts[t.InfoHash] != t {
+		//deleted, or carried over to a new client, while checking
+		e.mut.Unlock()
+		return
+	}
+	//completion of files, and whether the torrent is done
+	t.Update(tt)
+	if t.active {
+		e.download(t)
+	}
+	e.manageQueue()
+	name, done := t.Name, t.Percent
+	e.mut.Unlock()
+
+	log.Infof("Engine: Torrent <%s> checked, %.2f%% complete.", name, done)
+	e.publish(Event{Type: EventChecked, InfoHash: t.InfoHash})
+}
@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+// names of the profiles that are not configured as speed profiles
+const (
+	//DownloadRate and UploadRate, when nothing else applies
+	ProfileDefault = "default"
+	//AltDownloadRate and AltUploadRate, while AltSpeed is on
+	ProfileAlternative = "alternative"
+)
+
+// SpeedProfile is a named pair of global rate limits
+// in bytes per second, 0 is unlimited
+type SpeedProfile struct {
+	Name         string
+	DownloadRate int64
+	UploadRate   int64
+}
+
+// ScheduleEntry switches to a profile during a window of the week,
+// windows ending before they start run past midnight
+type ScheduleEntry struct {
+	Profile string
+	//days the window starts on, empty is every day
+	Days []time.Weekday
+	//local time of day as 15:04, equal times span the whole day
+	Start string
+	End   string
+}
+
+// minutes of the window after midnight
+func (s ScheduleEntry) window() (start, end int, err error) {
+	st, err := time.Parse("15:04", s.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start (%s)", s.Start)
+	}
+	et, err := time.Parse("15:04", s.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end (%s)", s.End)
+	}
+	return st.Hour()*60 + st.Minute(), et.Hour()*60 + et.Minute(), nil
+}
+
+func (s ScheduleEntry) startsOn(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// active tells whether now falls into the window
+func (s ScheduleEntry) active(now time.Time) bool {
+	start, end, err := s.window()
+	if err != nil {
+		return false
+	}
+	m := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case start == end:
+		return s.startsOn(today)
+	case start < end:
+		return s.startsOn(today) && m >= start && m < end
+	default:
+		return (s.startsOn(today) && m >= start) || (s.startsOn(yesterday) && m < end)
+	}
+}
+
+// validateSchedule checks the profiles and the schedule of c
+func validateSchedule(c Config) error {
+	if c.AltDownloadRate < 0 || c.AltUploadRate < 0 {
+		return fmt.Errorf("invalid alternative rate limit")
+	}
+	names := map[string]bool{}
+	for _, p := range c.SpeedProfiles {
+		switch {
+		case p.Name == "" || p.Name == ProfileDefault || p.Name == ProfileAlternative:
+			return fmt.Errorf("invalid speed profile name (%s)", p.Name)
+		case names[p.Name]:
+			return fmt.Errorf("speed profile %s defined twice", p.Name)
+		case p.DownloadRate < 0 || p.UploadRate < 0:
+			return fmt.Errorf("invalid rate limit of speed profile %s", p.Name)
+		}
+		names[p.Name] = true
+	}
+	for _, s := range c.SpeedSchedule {
+		if !names[s.Profile] {
+			return fmt.Errorf("missing speed profile %s", s.Profile)
+		}
+		if _, _, err := s.window(); err != nil {
+			return fmt.Errorf("invalid schedule of %s: %v", s.Profile, err)
+		}
+		for _, d := range s.Days {
+			if d < time.Sunday || d > time.Saturday {
+				return fmt.Errorf("invalid schedule of %s: invalid day (%d)", s.Profile, d)
+			}
+		}
+	}
+	return nil
+}
+
+// activeSpeed is the profile applying at now and its limits, the
+// alternative speed wins over the schedule, the first window over later ones
+func (c Config) activeSpeed(now time.Time) (profile string, download, upload int64) {
+	if c.AltSpeed {
+		return ProfileAlternative, c.AltDownloadRate, c.AltUploadRate
+	}
+	for _, s := range c.SpeedSchedule {
+		if !s.active(now) {
+			continue
+		}
+		for _, p := range c.SpeedProfiles {
+			if p.Name == s.Profile {
+				return p.Name, p.DownloadRate, p.UploadRate
+			}
+		}
+	}
+	return ProfileDefault, c.DownloadRate, c.UploadRate
+}
+
+// applySpeed switches the global limits to the profile
+// applying at now, e.mut must be held
+func (e *Engine) applySpeed(now time.Time) {
+	profile, download, upload := e.config.activeSpeed(now)
+	if profile == e.config.ActiveProfile && download == e.speedDownload && upload == e.speedUpload {
+		return
+	}
+	switched := profile != e.config.ActiveProfile
+	e.config.ActiveProfile = profile
+	e.speedDownload, e.speedUpload = download, upload
+	e.downloadLimiter.SetLimit(toLimit(download))
+	e.uploadLimiter.SetLimit(toLimit(upload))
+	for _, t := range e.ts {
+		e.updateLimits(t)
+	}
+	if switched {
+		log.Infof("Engine: Speed profile <%s> active.", profile)
+		e.publish(Event{Type: EventSpeedProfile})
+	}
+}
+
+// SetAltSpeed turns the alternative speed on or off, while
+// on it applies instead of any scheduled profile
+func (e *Engine) SetAltSpeed(on bool) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.AltSpeed = on
+	e.applySpeed(time.Now())
+	return nil
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+// SetSeedingGoals changes the global share ratio and seeding
+// time after which completed torrents are paused, 0 disables a goal
+func (e *Engine) SetSeedingGoals(ratio float32, seedTime time.Duration) error {
+	if ratio < 0 || seedTime < 0 {
+		return fmt.Errorf("invalid seeding goal")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.config.SeedRatio = ratio
+	e.config.SeedTime = seedTime
+	return nil
+}
+
+// SetTorrentSeedingGoals overrides the global seeding goals for
+// a single torrent, 0 falls back to the global goal
+func (e *Engine) SetTorrentSeedingGoals(infohash string, ratio float32, seedTime time.Duration) error {
+	if ratio < 0 || seedTime < 0 {
+		return fmt.Errorf("invalid seeding goal")
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.SeedRatio = ratio
+	t.SeedTime = seedTime
+	t.SeedingGoalReached = false
+	return e.saveState(t)
+}
+
+// checkSeeding accounts the time a completed torrent is seeding
+// and pauses it once one of its seeding goals is reached
+func (e *Engine) checkSeeding(t *Torrent, now time.Time) {
+	seeding := t.Done && !t.Paused && !t.Queued
+	if !seeding {
+		t.seededAt = time.Time{}
+		return
+	}
+	if !t.seededAt.IsZero() {
+		t.SeedingTime += now.Sub(t.seededAt)
+	}
+	t.seededAt = now
+	if t.SeedingGoalReached {
+		return
+	}
+	ratio := t.SeedRatio
+	if ratio <= 0 {
+		ratio = e.config.SeedRatio
+	}
+	seedTime := t.SeedTime
+	if seedTime <= 0 {
+		seedTime = e.config.SeedTime
+	}
+	if (ratio > 0 && t.Ratio >= ratio) || (seedTime > 0 && t.SeedingTime >= seedTime) {
+		log.Infof("Engine: Torrent <%s> reached its seeding goal, ratio: %.2f, time: %s.", t.Name, t.Ratio, t.SeedingTime)
+		t.SeedingGoalReached = true
+		e.pauseTorrent(t)
+		if err := e.saveState(t); err != nil {
+			e.fail(t.InfoHash, "failed to save torrent", err)
+		}
+	}
+}
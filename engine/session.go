@@ -0,0 +1,285 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// torrentState is what the engine persists about a torrent
+// next to its metainfo in the session directory
+type torrentState struct {
+	InfoHash      string              `json:"info_hash"`
+	Magnet        string              `json:"magnet,omitempty"`
+	Started       bool                `json:"started"`
+	Paused        bool                `json:"paused"`
+	AddedAt       time.Time           `json:"added_at"`
+	Files         map[string]Priority `json:"files,omitempty"`
+	QueuePosition int                 `json:"queue_position,omitempty"`
+	//download limit overriding the global one
+	DownloadLimit int64 `json:"download_limit,omitempty"`
+	//seeding goals overriding the global ones and the progress towards them
+	SeedRatio          float32       `json:"seed_ratio,omitempty"`
+	SeedTime           time.Duration `json:"seed_time,omitempty"`
+	SeedingTime        time.Duration `json:"seeding_time,omitempty"`
+	SeedingGoalReached bool          `json:"seeding_goal_reached,omitempty"`
+	Uploaded           int64         `json:"uploaded,omitempty"`
+	TimeActive         time.Duration `json:"time_active,omitempty"`
+	Trackers           [][]string    `json:"trackers"`
+	Streaming          bool          `json:"streaming,omitempty"`
+	StreamingFiles     []string      `json:"streaming_files,omitempty"`
+	//where the data is kept when not in the download directory
+	DataDirectory string   `json:"data_directory,omitempty"`
+	Category      string   `json:"category,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	//restored with an empty cache
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	//paused for not fitting into the download quota
+	OverQuota bool `json:"over_quota,omitempty"`
+	//made by CreateTorrent, its data stays where it was picked
+	Created bool `json:"created,omitempty"`
+}
+
+func (e *Engine) metainfoPath(infohash string) string {
+	return filepath.Join(e.cacheDir, infohash+".torrent")
+}
+
+func (e *Engine) statePath(infohash string) string {
+	return filepath.Join(e.cacheDir, infohash+".json")
+}
+
+// state is what gets persisted of t
+func (t *Torrent) state() torrentState {
+	s := torrentState{
+		InfoHash:           t.InfoHash,
+		Magnet:             t.magnet,
+		Started:            t.Started,
+		Paused:             t.Paused,
+		OverQuota:          t.overQuota,
+		Created:            t.created,
+		AddedAt:            t.AddedAt,
+		QueuePosition:      t.QueuePosition,
+		DownloadLimit:      t.DownloadLimit,
+		SeedRatio:          t.SeedRatio,
+		SeedTime:           t.SeedTime,
+		SeedingTime:        t.SeedingTime,
+		SeedingGoalReached: t.SeedingGoalReached,
+		Uploaded:           t.Uploaded,
+		TimeActive:         t.TimeActive,
+		Trackers:           trackerTiers(t.trackers),
+		DataDirectory:      t.dataDir,
+		Category:           t.Category,
+		Tags:               t.Tags,
+		Ephemeral:          t.Ephemeral,
+	}
+	if len(t.Files) > 0 {
+		s.Files = map[string]Priority{}
+		for _, f := range t.Files {
+			if f != nil {
+				s.Files[f.Path] = f.Priority
+				if f.Streaming {
+					s.StreamingFiles = append(s.StreamingFiles, f.Path)
+				}
+			}
+		}
+	}
+	return s
+}
+
+// saveState writes the torrent state, and its metainfo
+// once known, into the session directory, e.mut must be held
+func (e *Engine) saveState(t *Torrent) error {
+	if e.cacheDir == "" {
+		return nil
+	}
+	s := t.state()
+	if t.t != nil && t.t.Info() != nil {
+		if err := e.saveMetainfo(t.t); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(&s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(e.statePath(t.InfoHash), b); err != nil {
+		return err
+	}
+	t.saved = t.progress()
+	return nil
+}
+
+// progressSaveInterval is how often the progress of
+// the torrents is saved, see saveProgress
+const progressSaveInterval = 1 * time.Minute
+
+// progress is what changes of a torrent while it is running,
+// seeding goals and the ratio are worked out from it
+type progress struct {
+	uploaded    int64
+	seedingTime time.Duration
+	timeActive  time.Duration
+}
+
+func (t *Torrent) progress() progress {
+	return progress{t.Uploaded, t.SeedingTime, t.TimeActive}
+}
+
+// saveProgress saves every torrent that made progress since it was
+// last saved, so that little of it is lost on a crash. e.mut must be held.
+func (e *Engine) saveProgress(now time.Time) {
+	if now.Sub(e.savedAt) < progressSaveInterval {
+		return
+	}
+	e.savedAt = now
+	for _, t := range e.ts {
+		if t.progress() == t.saved {
+			continue
+		}
+		if err := e.saveState(t); err != nil {
+			e.fail(t.InfoHash, "failed to save torrent", err)
+		}
+	}
+}
+
+// Close saves every torrent and closes the client,
+// the engine must not be used afterwards
+func (e *Engine) Close() error {
+	e.configureMut.Lock()
+	defer e.configureMut.Unlock()
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.client == nil {
+		return nil
+	}
+	var err error
+	for _, t := range e.ts {
+		if serr := e.saveState(t); serr != nil {
+			e.fail(t.InfoHash, "failed to save torrent", serr)
+			err = serr
+		}
+	}
+	e.client.Close()
+	e.client = nil
+	e.closeStorages()
+	return err
+}
+
+// saveMetainfo writes the metainfo of tt unless there is one already,
+// which may hold more than anacrolix keeps, see CreateTorrent
+func (e *Engine) saveMetainfo(tt *torrent.Torrent) error {
+	p := e.metainfoPath(tt.InfoHash().HexString())
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	mi := tt.Metainfo()
+	return writeMetainfo(p, &mi)
+}
+
+func writeMetainfo(p string, mi *metainfo.MetaInfo) error {
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := mi.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (e *Engine) removeState(infohash string) {
+	os.Remove(e.metainfoPath(infohash))
+	os.Remove(e.statePath(infohash))
+}
+
+// loadSession re-adds every torrent found in the session
+// directory, in the order they had in the queue
+func (e *Engine) loadSession() error {
+	paths, err := filepath.Glob(filepath.Join(e.cacheDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	var states []torrentState
+	for _, p := range paths {
+		//the session directory holds more than torrent states
+		if _, err := str2ih(strings.TrimSuffix(filepath.Base(p), ".json")); err != nil {
+			continue
+		}
+		s, err := readState(p)
+		if err != nil {
+			log.Warnf("Engine: failed to restore %s: %v", filepath.Base(p), err)
+			continue
+		}
+		states = append(states, s)
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		pi, pj := states[i].QueuePosition, states[j].QueuePosition
+		if pi != pj {
+			//torrents without a position go last
+			return pj == 0 || (pi != 0 && pi < pj)
+		}
+		return states[i].AddedAt.Before(states[j].AddedAt)
+	})
+	for _, s := range states {
+		if err := e.restoreTorrent(s); err != nil {
+			e.fail(s.InfoHash, "failed to restore torrent", err)
+		}
+	}
+	return nil
+}
+
+func readState(path string) (torrentState, error) {
+	var s torrentState
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, err
+	}
+	if _, err := str2ih(s.InfoHash); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func (e *Engine) restoreTorrent(s torrentState) error {
+	client, err := e.torrentClient()
+	if err != nil {
+		return err
+	}
+	var tt *torrent.Torrent
+	if mi, merr := metainfo.LoadFromFile(e.metainfoPath(s.InfoHash)); merr == nil {
+		tt, err = e.addTorrent(client, mi, s)
+	} else if s.Magnet != "" {
+		tt, err = e.addMagnet(client, s.Magnet, s)
+	} else {
+		return fmt.Errorf("missing metainfo (%v)", merr)
+	}
+	if err != nil {
+		return err
+	}
+	return e.newTorrent(tt, s)
+}
+
+// writeFile replaces the file at path in one step so that
+// a crash never leaves a truncated state file behind
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/anacrolix/torrent/storage"
+	"path/filepath"
+)
+
+// storages of torrent data, see Config
+const (
+	StorageFile = "file"
+	StorageMMap = "mmap"
+)
+
+// databases keeping which pieces are complete, see Config
+const (
+	CompletionBolt   = "bolt"
+	CompletionSqlite = "sqlite"
+)
+
+func validateStorage(c Config) error {
+	switch c.Storage {
+	case "", StorageFile, StorageMMap:
+	default:
+		return fmt.Errorf("invalid storage (%s)", c.Storage)
+	}
+	switch c.PieceCompletion {
+	case "", CompletionBolt, CompletionSqlite:
+	default:
+		return fmt.Errorf("invalid piece completion (%s)", c.PieceCompletion)
+	}
+	return nil
+}
+
+// sharedCompletion is handed to every storage, which close their
+// completion along with themselves, it is only closed by closeStorages
+type sharedCompletion struct {
+	storage.PieceCompletion
+}
+
+func (sharedCompletion) Close() error {
+	return nil
+}
+
+// openStorage sets up the storage of a new client, the piece completion
+// database is kept in the session directory, without one every data
+// directory gets a database of its own
+func (e *Engine) openStorage(c Config) error {
+	e.closeStorages()
+	var completion storage.PieceCompletion
+	var err error
+	switch c.PieceCompletion {
+	case CompletionBolt:
+		completion, err = storage.NewBoltPieceCompletion(c.SessionDirectory)
+	case CompletionSqlite:
+		completion, err = storage.NewSqlitePieceCompletion(c.SessionDirectory)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open piece completion: %v", err)
+	}
+	e.storageMut.Lock()
+	defer e.storageMut.Unlock()
+	e.storageKind = c.Storage
+	e.completion = completion
+	return nil
+}
+
+// newStorage returns the storage of the torrents kept in dir, it is
+// shared so that every piece completion database is only opened once
+func (e *Engine) newStorage(dir string) storage.ClientImpl {
+	dir = filepath.Clean(dir)
+	e.storageMut.Lock()
+	defer e.storageMut.Unlock()
+	if s, ok := e.storages[dir]; ok {
+		return s
+	}
+	var impl storage.ClientImpl
+	switch {
+	case e.storageKind == StorageMMap && e.completion != nil:
+		impl = storage.NewMMapWithCompletion(dir, sharedCompletion{e.completion})
+	case e.storageKind == StorageMMap:
+		impl = storage.NewMMap(dir)
+	case e.completion != nil:
+		impl = storage.NewFileWithCompletion(dir, sharedCompletion{e.completion})
+	default:
+		impl = storage.NewFile(dir)
+	}
+	s := limitedStorage{impl, e.torrentLimiter}
+	e.storages[dir] = s
+	return s
+}
+
+// closeStorages closes the storages of a closed client
+func (e *Engine) closeStorages() {
+	e.storageMut.Lock()
+	defer e.storageMut.Unlock()
+	for dir, s := range e.storages {
+		s.Close()
+		delete(e.storages, dir)
+	}
+	if e.completion != nil {
+		e.completion.Close()
+		e.completion = nil
+	}
+	//the caches went along with their torrents
+	e.caches = map[string]*pieceCache{}
+}
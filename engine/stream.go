@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"io"
+	"sync/atomic"
+)
+
+// streamWindow is how far ahead of the playhead pieces
+// are downloaded with high priority
+const streamWindow = 16 << 20
+
+// FileReader reads a file of a torrent
+type FileReader interface {
+	io.ReadSeeker
+	io.Closer
+	//File is a snapshot of the file when it got opened
+	File() *File
+}
+
+// fileReader lets the engine know where playback is,
+// so it can fetch the pieces ahead
+type fileReader struct {
+	torrent.Reader
+	snapshot *File
+	file     *File
+	e        *Engine
+	t        *Torrent
+	pos      int64
+}
+
+func (r *fileReader) File() *File {
+	return r.snapshot
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(&r.pos, int64(n))
+	return n, err
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.Reader.Seek(offset, whence)
+	if err == nil {
+		atomic.StoreInt64(&r.pos, pos)
+	}
+	return pos, err
+}
+
+func (r *fileReader) Close() error {
+	r.e.mut.Lock()
+	delete(r.t.readers, r)
+	r.e.mut.Unlock()
+	return r.Reader.Close()
+}
+
+// NewFileReader opens the file with index id of the torrent
+func (e *Engine) NewFileReader(infohash string, id int) (FileReader, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	if id < 0 || id >= len(t.Files) || t.Files[id] == nil {
+		return nil, fmt.Errorf("missing file %d", id)
+	}
+	f := t.Files[id]
+	snapshot := *f
+	r := &fileReader{Reader: f.f.NewReader(), snapshot: &snapshot, file: f, e: e, t: t}
+	r.SetReadahead(streamWindow)
+	r.SetResponsive()
+	if t.readers == nil {
+		t.readers = map[*fileReader]struct{}{}
+	}
+	t.readers[r] = struct{}{}
+	return r, nil
+}
+
+// SetTorrentStreaming switches every file of the torrent
+// to sequential download
+func (e *Engine) SetTorrentStreaming(infohash string, on bool) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Streaming = on
+	return e.saveState(t)
+}
+
+// SetFileStreaming switches a single file to sequential download
+func (e *Engine) SetFileStreaming(infohash, filepath string, on bool) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	for _, f := range t.Files {
+		if f != nil && f.Path == filepath {
+			f.Streaming = on
+			return e.saveState(t)
+		}
+	}
+	return fmt.Errorf("missing file %s", filepath)
+}
+
+// stream prioritizes the pieces of streamed files: the first and
+// last piece for container headers and indexes, then a window from
+// the first missing piece on and one ahead of every reader. Ephemeral
+// torrents only get the windows of readers, which their cache follows.
+// e.mut must be held.
+func (e *Engine) stream(t *Torrent) {
+	if !t.active || t.t == nil || t.t.Info() == nil {
+		return
+	}
+	pieceLength := t.t.Info().PieceLength
+	window := int((streamWindow + pieceLength - 1) / pieceLength)
+	now := map[int]bool{}
+	high := map[int]bool{}
+	playhead := -1
+	for _, f := range t.Files {
+		if f == nil || f.f == nil || f.Size == 0 {
+			continue
+		}
+		sequential := (t.Streaming || f.Streaming) && f.Priority != PrioritySkip && !t.Ephemeral
+		var heads []int
+		first := int(f.f.Offset() / pieceLength)
+		last := int((f.f.Offset() + f.Size - 1) / pieceLength)
+		if sequential {
+			now[first] = true
+			now[last] = true
+			for i := first; i <= last; i++ {
+				if !t.t.PieceState(i).Complete {
+					heads = append(heads, i)
+					break
+				}
+			}
+		}
+		for r := range t.readers {
+			if r.file == f {
+				head := int((f.f.Offset() + atomic.LoadInt64(&r.pos)) / pieceLength)
+				heads = append(heads, head)
+				if playhead < 0 || head < playhead {
+					playhead = head
+				}
+			}
+		}
+		for _, head := range heads {
+			for i := head; i < head+window && i <= last; i++ {
+				high[i] = true
+			}
+		}
+	}
+	if t.Ephemeral {
+		if c := e.torrentCache(t.InfoHash); c != nil {
+			c.setPlayhead(playhead)
+		}
+	}
+	for i := range t.streamPieces {
+		if !now[i] && !high[i] {
+			t.t.Piece(i).SetPriority(torrent.PiecePriorityNone)
+			delete(t.streamPieces, i)
+		}
+	}
+	if t.streamPieces == nil {
+		t.streamPieces = map[int]bool{}
+	}
+	for i := range high {
+		if !now[i] && !t.t.PieceState(i).Complete {
+			t.t.Piece(i).SetPriority(torrent.PiecePriorityHigh)
+			t.streamPieces[i] = true
+		}
+	}
+	for i := range now {
+		if !t.t.PieceState(i).Complete {
+			t.t.Piece(i).SetPriority(torrent.PiecePriorityNow)
+			t.streamPieces[i] = true
+		}
+	}
+}
+
+// stopStreaming drops the priorities stream gave to pieces
+func (e *Engine) stopStreaming(t *Torrent) {
+	for i := range t.streamPieces {
+		t.t.Piece(i).SetPriority(torrent.PiecePriorityNone)
+	}
+	t.streamPieces = nil
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"github.com/anacrolix/torrent"
+	"math"
 	"time"
 )
 
@@ -13,13 +14,69 @@ type Torrent struct {
 	Downloaded int64
 	Size       int64
 	Files      []*File
+	//where the data is kept
+	Directory string
+	Category  string
+	Tags      []string
 	//cloud torrent
-	Started      bool
-	Dropped      bool
-	Percent      float32
+	Started       bool
+	Paused        bool
+	Done          bool
+	Queued        bool
+	QueuePosition int
+	//download sequentially, for playback while downloading
+	Streaming bool
+	//pieces are cached while streamed instead of kept, see AddOptions
+	Ephemeral bool
+	Dropped   bool
+	Percent   float32
+	//pieces are being hashed again, CheckProgress is the percentage done
+	Checking      bool
+	CheckProgress float32
+	//rates in bytes per second, smoothed over a few seconds
 	DownloadRate float32
-	t            *torrent.Torrent
-	updatedAt    time.Time
+	UploadRate   float32
+	Uploaded     int64
+	Ratio        float32
+	//bytes left of the files that are not skipped
+	Remaining int64
+	//time until done, -1 when unknown
+	ETA time.Duration
+	//connected peers, of which seeds, and all peers known for the swarm,
+	//anacrolix keeps which pieces peers have to itself, so the availability
+	//of the swarm is unknown
+	Peers      int
+	Seeds      int
+	KnownPeers int
+	//bytes received that were not used
+	Wasted     int64
+	TimeActive time.Duration
+	AddedAt    time.Time
+	//seeding goals overriding the global ones, 0 falls back to the global goal
+	SeedRatio          float32
+	SeedTime           time.Duration
+	SeedingTime        time.Duration
+	SeedingGoalReached bool
+	//download limit in bytes per second, 0 falls back to the global limit,
+	//uploads only have the global limit, see SetTorrentRateLimits
+	DownloadLimit          int64
+	EffectiveDownloadLimit int64
+	EffectiveUploadLimit   int64
+	t                      *torrent.Torrent
+	trackers               []*Tracker
+	announceNow            chan struct{}
+	readers                map[*fileReader]struct{}
+	streamPieces           map[int]bool
+	magnet                 string
+	dataDir                string
+	active                 bool
+	overQuota              bool
+	created                bool
+	uploadedBase           int64
+	read                   int64
+	seededAt               time.Time
+	saved                  progress
+	updatedAt              time.Time
 }
 
 type File struct {
@@ -29,13 +86,15 @@ type File struct {
 	Chunks    int
 	Completed int
 	//cloud torrent
-	Started bool
-	Percent float32
-	f       torrent.File
+	Started   bool
+	Priority  Priority
+	Streaming bool
+	Percent   float32
+	f         *torrent.File
 }
 
 func (f *File) GetFile() *torrent.File {
-	return &f.f
+	return f.f
 }
 
 func (torrent *Torrent) Update(t *torrent.Torrent) {
@@ -45,6 +104,7 @@ func (torrent *Torrent) Update(t *torrent.Torrent) {
 	if torrent.Loaded {
 		torrent.updateLoaded(t)
 	}
+	torrent.updateStats(t)
 	torrent.t = t
 }
 
@@ -62,7 +122,7 @@ func (torrent *Torrent) updateLoaded(t *torrent.Torrent) {
 		path := f.Path()
 		file := torrent.Files[i]
 		if file == nil {
-			file = &File{Path: path}
+			file = &File{Path: path, Started: true, Priority: PriorityNormal}
 			torrent.Files[i] = file
 		}
 		chunks := f.State()
@@ -77,28 +137,107 @@ func (torrent *Torrent) updateLoaded(t *torrent.Torrent) {
 		}
 		file.Completed = completed
 		file.Percent = percent(int64(file.Completed), int64(file.Chunks))
-		file.f = *f
+		file.f = f
 
 		totalChunks += file.Chunks
 		totalCompleted += file.Completed
 	}
 
-	//cacluate rate
-	now := time.Now()
+	//done once every selected file is complete
+	torrent.Done = true
+	torrent.Remaining = 0
+	for _, f := range torrent.Files {
+		if f == nil || f.Priority == PrioritySkip {
+			continue
+		}
+		if f.Completed < f.Chunks {
+			torrent.Done = false
+		}
+		torrent.Remaining += f.Size - bytesCompleted(f.f)
+	}
+
 	bytes := t.BytesCompleted()
 	torrent.Percent = percent(bytes, torrent.Size)
+	torrent.Downloaded = bytes
+}
+
+// rateSmoothing is the time constant of the moving
+// average the rates are smoothed with
+const rateSmoothing = 5 * time.Second
+
+func (torrent *Torrent) updateStats(t *torrent.Torrent) {
+	now := time.Now()
+	stats := t.Stats()
+	read := stats.BytesReadUsefulData.Int64()
+	uploaded := torrent.uploadedBase + stats.BytesWrittenData.Int64()
+
+	torrent.Peers = stats.ActivePeers
+	torrent.Seeds = stats.ConnectedSeeders
+	torrent.KnownPeers = stats.TotalPeers
+	torrent.Wasted = stats.BytesReadData.Int64() - read
+
+	//cacluate rate
 	if !torrent.updatedAt.IsZero() {
-		dt := float32(now.Sub(torrent.updatedAt))
-		db := float32(bytes - torrent.Downloaded)
-		rate := db * (float32(time.Second) / dt)
-		if rate >= 0 {
-			torrent.DownloadRate = rate
+		if dt := now.Sub(torrent.updatedAt); dt > 0 {
+			torrent.DownloadRate = smooth(torrent.DownloadRate, read-torrent.read, dt)
+			torrent.UploadRate = smooth(torrent.UploadRate, uploaded-torrent.Uploaded, dt)
+			if !torrent.Paused && !torrent.Queued {
+				torrent.TimeActive += dt
+			}
 		}
 	}
-	torrent.Downloaded = bytes
+	torrent.read = read
+	torrent.Uploaded = uploaded
+	if torrent.Downloaded > 0 {
+		torrent.Ratio = float32(float64(uploaded) / float64(torrent.Downloaded))
+	}
+
+	switch {
+	case torrent.Done:
+		torrent.ETA = 0
+	case torrent.Loaded && torrent.DownloadRate >= 1:
+		torrent.ETA = time.Duration(float64(torrent.Remaining) / float64(torrent.DownloadRate) * float64(time.Second))
+	default:
+		torrent.ETA = -1
+	}
 	torrent.updatedAt = now
 }
 
+// smooth folds the n bytes transferred during dt into
+// the moving average prev
+func smooth(prev float32, n int64, dt time.Duration) float32 {
+	if n < 0 {
+		n = 0
+	}
+	rate := float64(n) / dt.Seconds()
+	alpha := 1 - math.Exp(-float64(dt)/float64(rateSmoothing))
+	return float32(float64(prev) + alpha*(rate-float64(prev)))
+}
+
+// snapshot copies t so that it can be read, or encoded,
+// without holding the engine lock
+func (t *Torrent) snapshot() *Torrent {
+	c := *t
+	c.Files = make([]*File, len(t.Files))
+	for i, f := range t.Files {
+		if f != nil {
+			fc := *f
+			c.Files[i] = &fc
+		}
+	}
+	c.Tags = append([]string(nil), t.Tags...)
+	c.t = nil
+	c.trackers = nil
+	c.announceNow = nil
+	c.readers = nil
+	c.streamPieces = nil
+	return &c
+}
+
+func (t *Torrent) setMaxConns(n int) {
+	t.t.SetMaxEstablishedConns(n)
+}
+
 func percent(n, total int64) float32 {
 	if total == 0 {
 		return float32(0)
@@ -0,0 +1,390 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/tracker"
+	"net/url"
+	"time"
+)
+
+// the engine announces to trackers itself, anacrolix would
+// neither report the outcome nor allow removing a tracker.
+// Tiers are used as of BEP 12: the first tracker that works is
+// announced to, later ones only while every tracker before it fails.
+const (
+	minAnnounceInterval     = 1 * time.Minute
+	defaultAnnounceInterval = 30 * time.Minute
+	announceRetryInterval   = 5 * time.Minute
+	announceTimeout         = 30 * time.Second
+)
+
+// Tracker is a tracker of a torrent and the outcome
+// of its last announce
+type Tracker struct {
+	URL          string
+	Tier         int
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+	Seeders      int
+	Leechers     int
+	Peers        int
+	LastError    string
+	started      bool
+	completed    bool
+}
+
+func newPeerID() (id [20]byte) {
+	copy(id[:], "-PF0001-")
+	rand.Read(id[8:])
+	return
+}
+
+func validTrackerURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid tracker url: %v", err)
+	}
+	switch parsed.Scheme {
+	case "http", "https", "udp":
+		return nil
+	}
+	return fmt.Errorf("unsupported tracker scheme (%s)", parsed.Scheme)
+}
+
+func newTrackers(tiers [][]string) []*Tracker {
+	var trackers []*Tracker
+	seen := map[string]bool{}
+	for tier, urls := range tiers {
+		for _, u := range urls {
+			if seen[u] || validTrackerURL(u) != nil {
+				continue
+			}
+			seen[u] = true
+			trackers = append(trackers, &Tracker{URL: u, Tier: tier})
+		}
+	}
+	return trackers
+}
+
+func trackerTiers(trackers []*Tracker) [][]string {
+	var tiers [][]string
+	for _, tr := range trackers {
+		for len(tiers) <= tr.Tier {
+			tiers = append(tiers, nil)
+		}
+		tiers[tr.Tier] = append(tiers[tr.Tier], tr.URL)
+	}
+	//drop tiers emptied by removed trackers
+	compact := make([][]string, 0, len(tiers))
+	for _, tier := range tiers {
+		if len(tier) > 0 {
+			compact = append(compact, tier)
+		}
+	}
+	return compact
+}
+
+// Trackers returns the trackers of the torrent
+func (e *Engine) Trackers(infohash string) ([]Tracker, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	trackers := make([]Tracker, len(t.trackers))
+	for i, tr := range t.trackers {
+		trackers[i] = *tr
+	}
+	return trackers, nil
+}
+
+// AddTracker adds a tracker to the given tier, a negative
+// tier adds it to a new tier after all others
+func (e *Engine) AddTracker(infohash, u string, tier int) error {
+	if err := validTrackerURL(u); err != nil {
+		return err
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	last := -1
+	for _, tr := range t.trackers {
+		if tr.URL == u {
+			return fmt.Errorf("tracker already added")
+		}
+		if tr.Tier > last {
+			last = tr.Tier
+		}
+	}
+	if tier < 0 || tier > last+1 {
+		tier = last + 1
+	}
+	//kept in tier order, announceDue relies on it
+	t.trackers = renumberTiers(append(t.trackers, &Tracker{URL: u, Tier: tier}))
+	t.reannounce()
+	return e.saveState(t)
+}
+
+func (e *Engine) RemoveTracker(infohash, u string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	for i, tr := range t.trackers {
+		if tr.URL == u {
+			t.trackers = renumberTiers(append(t.trackers[:i], t.trackers[i+1:]...))
+			return e.saveState(t)
+		}
+	}
+	return fmt.Errorf("missing tracker %s", u)
+}
+
+// renumberTiers closes the gaps removed trackers left
+// in the tiers, keeping the announce state of every tracker
+func renumberTiers(trackers []*Tracker) []*Tracker {
+	tiers := trackerTiers(trackers)
+	byURL := map[string]*Tracker{}
+	for _, tr := range trackers {
+		byURL[tr.URL] = tr
+	}
+	renumbered := make([]*Tracker, 0, len(trackers))
+	for tier, urls := range tiers {
+		for _, u := range urls {
+			tr := byURL[u]
+			tr.Tier = tier
+			renumbered = append(renumbered, tr)
+		}
+	}
+	return renumbered
+}
+
+// Reannounce announces the torrent right away, trackers that
+// failed are tried again
+func (e *Engine) Reannounce(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if t.Paused || t.Queued {
+		return fmt.Errorf("torrent is not active")
+	}
+	for _, tr := range t.trackers {
+		tr.NextAnnounce = time.Time{}
+	}
+	t.reannounce()
+	return nil
+}
+
+func (t *Torrent) reannounce() {
+	select {
+	case t.announceNow <- struct{}{}:
+	default:
+	}
+}
+
+// announcer announces tt to the trackers of t whenever they are
+// due, until tt is closed. It waits for the announcer of a previous
+// torrent of the same infohash, so that trackers learn about the
+// stop before the start.
+func (e *Engine) announcer(t *Torrent, tt *torrent.Torrent, prev <-chan struct{}, done chan struct{}) {
+	defer func() {
+		e.mut.Lock()
+		if e.announcers[t.InfoHash] == done {
+			delete(e.announcers, t.InfoHash)
+		}
+		e.mut.Unlock()
+		close(done)
+	}()
+	if prev != nil {
+		<-prev
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-tt.Closed():
+			e.announceStopped(t, tt)
+			return
+		case <-t.announceNow:
+		case <-timer.C:
+		}
+		wait := e.announceDue(t, tt)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// announceDue announces to the first tracker in tier order that is due,
+// falling back to the next one while announcing fails, and returns how
+// long until the next announce. Paused and queued torrents have no use
+// for peers, the trackers they were announced to are told they stopped.
+func (e *Engine) announceDue(t *Torrent, tt *torrent.Torrent) time.Duration {
+	for {
+		e.mut.Lock()
+		tr, req, wait := e.nextAnnounce(t, tt, t.Paused || t.Queued)
+		e.mut.Unlock()
+		if tr == nil {
+			if wait < time.Second {
+				wait = time.Second
+			}
+			return wait
+		}
+		e.announce(t, tt, tr, req)
+	}
+}
+
+// announceStopped tells every tracker the closed tt was announced to
+// that it stopped
+func (e *Engine) announceStopped(t *Torrent, tt *torrent.Torrent) {
+	for {
+		e.mut.Lock()
+		tr, req, _ := e.nextAnnounce(t, tt, true)
+		e.mut.Unlock()
+		if tr == nil {
+			return
+		}
+		e.announce(t, tt, tr, req)
+	}
+}
+
+// nextAnnounce returns the tracker to announce to and the request,
+// or how long until one is due. When stopping, it is the next
+// tracker that was told about a start. e.mut must be held.
+func (e *Engine) nextAnnounce(t *Torrent, tt *torrent.Torrent, stopping bool) (*Tracker, tracker.AnnounceRequest, time.Duration) {
+	req := tracker.AnnounceRequest{
+		InfoHash:   tt.InfoHash(),
+		PeerId:     e.peerID,
+		Downloaded: t.Downloaded,
+		Uploaded:   t.Uploaded,
+		Left:       uint64(t.Remaining),
+		NumWant:    -1,
+		Port:       uint16(e.config.IncomingPort),
+	}
+	if !t.Loaded {
+		//unknown, any non zero value makes us a leecher
+		req.Left = 1
+	}
+	if stopping {
+		for _, tr := range t.trackers {
+			if tr.started {
+				req.Event = tracker.Stopped
+				req.NumWant = 0
+				return tr, req, 0
+			}
+		}
+		return nil, req, defaultAnnounceInterval
+	}
+	now := time.Now()
+	wait := defaultAnnounceInterval
+	for _, tr := range t.trackers {
+		if tr.NextAnnounce.After(now) {
+			if d := tr.NextAnnounce.Sub(now); d < wait {
+				wait = d
+			}
+			if tr.LastError == "" {
+				//it works, no fallback needed
+				return nil, req, wait
+			}
+			//failed, retried later, until then the next one is used
+			continue
+		}
+		switch {
+		case !tr.started:
+			req.Event = tracker.Started
+		case t.Done && !tr.completed:
+			req.Event = tracker.Completed
+		}
+		return tr, req, 0
+	}
+	return nil, req, wait
+}
+
+// announce sends req to tr and records the outcome, a tracker that
+// works moves to the front of its tier
+func (e *Engine) announce(t *Torrent, tt *torrent.Torrent, tr *Tracker, req tracker.AnnounceRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	res, err := tracker.Announce{
+		TrackerUrl: tr.URL,
+		Request:    req,
+		UserAgent:  "PooFlix",
+		Context:    ctx,
+	}.Do()
+	cancel()
+
+	var peers []torrent.Peer
+	if err == nil && req.Event != tracker.Stopped {
+		for _, p := range res.Peers {
+			peers = append(peers, torrent.Peer{IP: p.IP, Port: p.Port})
+		}
+		tt.AddPeers(peers)
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	tr.LastAnnounce = time.Now()
+	switch {
+	case req.Event == tracker.Stopped:
+		//not retried, the tracker forgets about us soon enough
+		tr.started = false
+		tr.Peers = 0
+		tr.NextAnnounce = time.Time{}
+		tr.LastError = ""
+		if err != nil {
+			tr.LastError = err.Error()
+		}
+	case err != nil:
+		tr.LastError = err.Error()
+		tr.NextAnnounce = tr.LastAnnounce.Add(announceRetryInterval)
+	default:
+		interval := time.Duration(res.Interval) * time.Second
+		if interval < minAnnounceInterval {
+			interval = minAnnounceInterval
+		}
+		tr.LastError = ""
+		tr.Seeders = int(res.Seeders)
+		tr.Leechers = int(res.Leechers)
+		tr.Peers = len(peers)
+		tr.NextAnnounce = tr.LastAnnounce.Add(interval)
+		tr.started = true
+		tr.completed = tr.completed || req.Event == tracker.Completed
+		t.trackers = promoteTracker(t.trackers, tr)
+	}
+}
+
+// promoteTracker moves tr to the front of its tier, unless
+// it got removed while it was announced to
+func promoteTracker(trackers []*Tracker, tr *Tracker) []*Tracker {
+	promoted := make([]*Tracker, 0, len(trackers))
+	placed, found := false, false
+	for _, other := range trackers {
+		if !placed && other.Tier == tr.Tier {
+			promoted = append(promoted, tr)
+			placed = true
+		}
+		if other == tr {
+			found = true
+			continue
+		}
+		promoted = append(promoted, other)
+	}
+	if !found {
+		return trackers
+	}
+	return promoted
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/pooflix/client"
 	"github.com/pooflix/core"
+	"github.com/pooflix/engine"
 	"github.com/urfave/cli"
 	"net/url"
 	"os"
@@ -51,17 +52,11 @@ func main() {
 			Aliases: []string{"c"},
 			Usage:   "add torrent",
 			Action: func(ctx *cli.Context) error {
-				cfg := ctx.App.Metadata["config"].(*core.Config)
-				ip, err := core.GetLocalIp()
+				cl, err := newClient(ctx)
 				if err != nil {
 					return err
 				}
 
-				cl := client.NewClient(&url.URL{
-					Host:   fmt.Sprintf("%s:%s", ip, cfg.HttpServerPort),
-					Scheme: "http",
-					Path:   "/api/v1",
-				})
 				torrents, err := cl.ListTorrents()
 				if err != nil {
 					return err
@@ -73,6 +68,42 @@ func main() {
 
 				return nil
 			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add torrent from .torrent file",
+					ArgsUsage: "<file.torrent>",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "category", Usage: "category of torrent"},
+						cli.StringSliceFlag{Name: "tag", Usage: "tag of torrent, may be repeated"},
+						cli.BoolFlag{Name: "paused", Usage: "add torrent paused"},
+						cli.BoolFlag{Name: "ephemeral", Usage: "only stream torrent, keeping its pieces in a bounded cache"},
+					},
+					Action: func(ctx *cli.Context) error {
+						if ctx.NArg() != 1 {
+							return cli.NewExitError("expected path of a .torrent file", 1)
+						}
+
+						cl, err := newClient(ctx)
+						if err != nil {
+							return err
+						}
+
+						f, err := os.Open(ctx.Args().First())
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+
+						return cl.AddTorrentFile(f.Name(), f, engine.AddOptions{
+							Category:  ctx.String("category"),
+							Tags:      ctx.StringSlice("tag"),
+							Paused:    ctx.Bool("paused"),
+							Ephemeral: ctx.Bool("ephemeral"),
+						})
+					},
+				},
+			},
 		},
 	}
 
@@ -94,3 +125,17 @@ func main() {
 		panic(err)
 	}
 }
+
+func newClient(ctx *cli.Context) (*client.Client, error) {
+	cfg := ctx.App.Metadata["config"].(*core.Config)
+	ip, err := core.GetLocalIp()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NewClient(&url.URL{
+		Host:   fmt.Sprintf("%s:%s", ip, cfg.HttpServerPort),
+		Scheme: "http",
+		Path:   "/api/v1",
+	}), nil
+}